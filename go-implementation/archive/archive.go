@@ -0,0 +1,324 @@
+// Package archive implements the canonical serialization of a directory tree
+// that lake uses to hash, cache and copy store outputs.
+//
+// An archive only contains what an output's contents depend on. Entries are
+// sorted by name, regular files are either executable or not, symlinks are
+// stored as their target and there are no timestamps, owners or other
+// permission bits. Dumping the same tree always produces the same bytes.
+//
+// The format is similar to Nix's NAR:
+//
+//	archive   = str("lake-archive-1") node
+//	node      = str("regular") str(contents)
+//	          | str("executable") str(contents)
+//	          | str("symlink") str(target)
+//	          | str("directory") { str("entry") str(name) node } str("end")
+//	str       = uint64 little-endian length, bytes, zero padding to 8 bytes
+//
+// Directory entries must be in strictly increasing order by name.
+package archive
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const magic = "lake-archive-1"
+
+const (
+	typeRegular    = "regular"
+	typeExecutable = "executable"
+	typeSymlink    = "symlink"
+	typeDirectory  = "directory"
+	tokenEntry     = "entry"
+	tokenEnd       = "end"
+)
+
+// maxTokenSize limits the size of everything other than file contents that
+// Restore will read
+const maxTokenSize = 4096
+
+// Dump writes the archive of the file, directory or symlink at path to w
+func Dump(w io.Writer, path string) error {
+	aw := &writer{w: w}
+	aw.str(magic)
+	if aw.err != nil {
+		return aw.err
+	}
+	return aw.node(path)
+}
+
+// Hash returns the sha256 of the archive of path
+func Hash(path string) ([]byte, error) {
+	h := sha256.New()
+	if err := Dump(h, path); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+type writer struct {
+	w   io.Writer
+	err error
+}
+
+func (aw *writer) str(s string) {
+	aw.header(int64(len(s)))
+	aw.write([]byte(s))
+	aw.pad(int64(len(s)))
+}
+
+func (aw *writer) header(size int64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(size))
+	aw.write(b[:])
+}
+
+func (aw *writer) pad(size int64) {
+	if n := padding(size); n > 0 {
+		aw.write(make([]byte, n))
+	}
+}
+
+func (aw *writer) write(b []byte) {
+	if aw.err == nil {
+		_, aw.err = aw.w.Write(b)
+	}
+}
+
+func padding(size int64) int64 { return (8 - size%8) % 8 }
+
+func (aw *writer) node(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	switch mode := fi.Mode(); {
+	case mode&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		aw.str(typeSymlink)
+		aw.str(target)
+	case mode.IsRegular():
+		if mode&0111 != 0 {
+			aw.str(typeExecutable)
+		} else {
+			aw.str(typeRegular)
+		}
+		if err := aw.contents(path, fi.Size()); err != nil {
+			return err
+		}
+	case mode.IsDir():
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		// ReadDir sorts by filename already, sort again to not depend on it
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+		aw.str(typeDirectory)
+		for _, entry := range entries {
+			aw.str(tokenEntry)
+			aw.str(entry.Name())
+			if aw.err != nil {
+				return aw.err
+			}
+			if err := aw.node(filepath.Join(path, entry.Name())); err != nil {
+				return err
+			}
+		}
+		aw.str(tokenEnd)
+	default:
+		return errors.Errorf("can't archive %q, unsupported file type %s", path, fi.Mode().Type())
+	}
+	return aw.err
+}
+
+func (aw *writer) contents(path string, size int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	aw.header(size)
+	if aw.err != nil {
+		return aw.err
+	}
+	n, err := io.Copy(aw.w, io.LimitReader(f, size))
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return errors.Errorf("%q changed size while it was being archived", path)
+	}
+	aw.pad(size)
+	return aw.err
+}
+
+// Restore reads an archive from r and recreates it at path, which must not
+// exist. Regular files are created with mode 0644, executables and
+// directories with 0755.
+func Restore(r io.Reader, path string) error {
+	ar := &reader{r: r}
+	s, err := ar.str()
+	if err != nil {
+		return err
+	}
+	if s != magic {
+		return errors.New("not a lake archive")
+	}
+	if err := ar.node(path); err != nil {
+		return err
+	}
+	// Trailing data means the archive isn't canonical
+	if n, _ := r.Read(make([]byte, 1)); n != 0 {
+		return errors.New("invalid archive, unexpected data after the end of the archive")
+	}
+	return nil
+}
+
+type reader struct {
+	r io.Reader
+}
+
+func (ar *reader) header() (int64, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(ar.r, b[:]); err != nil {
+		return 0, errors.Wrap(unexpectedEOF(err), "error reading archive")
+	}
+	size := binary.LittleEndian.Uint64(b[:])
+	if size > 1<<62 {
+		return 0, errors.Errorf("invalid archive, string length %d is too large", size)
+	}
+	return int64(size), nil
+}
+
+func (ar *reader) pad(size int64) error {
+	b := make([]byte, padding(size))
+	if _, err := io.ReadFull(ar.r, b); err != nil {
+		return errors.Wrap(unexpectedEOF(err), "error reading archive")
+	}
+	if !bytes.Equal(b, make([]byte, len(b))) {
+		return errors.New("invalid archive, padding is not zero")
+	}
+	return nil
+}
+
+func (ar *reader) str() (string, error) {
+	size, err := ar.header()
+	if err != nil {
+		return "", err
+	}
+	if size > maxTokenSize {
+		return "", errors.Errorf("invalid archive, string length %d is too large", size)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(ar.r, b); err != nil {
+		return "", errors.Wrap(unexpectedEOF(err), "error reading archive")
+	}
+	return string(b), ar.pad(size)
+}
+
+func (ar *reader) expect(tokens ...string) (string, error) {
+	s, err := ar.str()
+	if err != nil {
+		return "", err
+	}
+	for _, token := range tokens {
+		if s == token {
+			return s, nil
+		}
+	}
+	return "", errors.Errorf("invalid archive, expected one of %q, got %q", tokens, s)
+}
+
+func (ar *reader) node(path string) error {
+	typ, err := ar.expect(typeRegular, typeExecutable, typeSymlink, typeDirectory)
+	if err != nil {
+		return err
+	}
+	switch typ {
+	case typeRegular, typeExecutable:
+		var perm os.FileMode = 0644
+		if typ == typeExecutable {
+			perm = 0755
+		}
+		return ar.contents(path, perm)
+	case typeSymlink:
+		target, err := ar.str()
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, path)
+	}
+
+	if err := os.Mkdir(path, 0755); err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0755); err != nil {
+		return err
+	}
+	var previous string
+	for {
+		token, err := ar.expect(tokenEntry, tokenEnd)
+		if err != nil {
+			return err
+		}
+		if token == tokenEnd {
+			return nil
+		}
+		name, err := ar.str()
+		if err != nil {
+			return err
+		}
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+			return errors.Errorf("invalid archive, invalid entry name %q", name)
+		}
+		if previous != "" && name <= previous {
+			return errors.Errorf("invalid archive, entry %q is not sorted after %q", name, previous)
+		}
+		previous = name
+		if err := ar.node(filepath.Join(path, name)); err != nil {
+			return err
+		}
+	}
+}
+
+func (ar *reader) contents(path string, perm os.FileMode) error {
+	size, err := ar.header()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(f, ar.r, size); err != nil {
+		_ = f.Close()
+		return errors.Wrap(unexpectedEOF(err), "error reading archive")
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	// The umask can remove permission bits, set them explicitly
+	if err := os.Chmod(path, perm); err != nil {
+		return err
+	}
+	return ar.pad(size)
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
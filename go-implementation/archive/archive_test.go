@@ -0,0 +1,143 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTree(t *testing.T, dir string) {
+	for _, f := range []struct {
+		path string
+		body string
+		perm os.FileMode
+	}{
+		{"b/file", "hello\n", 0600},
+		{"a", "", 0644},
+		{"bin/run", "#!/bin/sh\necho hi\n", 0700},
+	} {
+		path := filepath.Join(dir, f.path)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(f.body), f.perm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("../b/file", filepath.Join(dir, "bin", "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "empty"), 0700); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDumpRestore(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	writeTree(t, src)
+
+	var archive bytes.Buffer
+	if err := Dump(&archive, src); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(t.TempDir(), "dst")
+	if err := Restore(bytes.NewReader(archive.Bytes()), dst); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dst, "b", "file"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\n", string(b))
+	target, err := os.Readlink(filepath.Join(dst, "bin", "link"))
+	assert.NoError(t, err)
+	assert.Equal(t, "../b/file", target)
+	for path, perm := range map[string]os.FileMode{
+		"a":       0644,
+		"b/file":  0644,
+		"bin/run": 0755,
+		"empty":   0755 | os.ModeDir,
+	} {
+		fi, err := os.Stat(filepath.Join(dst, path))
+		assert.NoError(t, err)
+		assert.Equal(t, perm, fi.Mode(), path)
+	}
+
+	// The restored tree dumps to the same bytes
+	var again bytes.Buffer
+	if err := Dump(&again, dst); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, archive.Bytes(), again.Bytes())
+}
+
+func TestHash(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("hi"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Golden value, changing the format changes every output hash
+	sum, err := Hash(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, "d693dffef4ef4a0d5c0f54a46ef094b0c3a293b1e2554dd0a54cf4008c9a2fac", hex.EncodeToString(sum))
+
+	// Timestamps and permission bits other than executable don't matter
+	if err := os.Chmod(filepath.Join(dir, "file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(dir, "file"), time.Unix(0, 0), time.Unix(0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	again, _ := Hash(dir)
+	assert.Equal(t, sum, again)
+
+	if err := os.Chmod(filepath.Join(dir, "file"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	executable, _ := Hash(dir)
+	assert.NotEqual(t, sum, executable)
+}
+
+func TestRestoreInvalid(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	writeTree(t, src)
+	var archive bytes.Buffer
+	if err := Dump(&archive, src); err != nil {
+		t.Fatal(err)
+	}
+	valid := archive.Bytes()
+
+	str := func(s string) []byte {
+		var buf bytes.Buffer
+		aw := &writer{w: &buf}
+		aw.str(s)
+		return buf.Bytes()
+	}
+	concat := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	for name, tt := range map[string]struct {
+		archive []byte
+		err     string
+	}{
+		"bad magic":   {str("nix-archive-1"), "not a lake archive"},
+		"truncated":   {valid[:len(valid)-8], "unexpected EOF"},
+		"trailing":    {append(append([]byte{}, valid...), 0), "unexpected data"},
+		"bad type":    {concat(str(magic), str("fifo")), "expected one of"},
+		"dot dot":     {concat(str(magic), str(typeDirectory), str(tokenEntry), str(".."), str(typeRegular), str("")), `invalid entry name ".."`},
+		"slash":       {concat(str(magic), str(typeDirectory), str(tokenEntry), str("a/b"), str(typeRegular), str("")), "invalid entry name"},
+		"not sorted":  {concat(str(magic), str(typeDirectory), str(tokenEntry), str("b"), str(typeRegular), str(""), str(tokenEntry), str("a"), str(typeRegular), str(""), str(tokenEnd)), "is not sorted"},
+		"duplicate":   {concat(str(magic), str(typeDirectory), str(tokenEntry), str("a"), str(typeRegular), str(""), str(tokenEntry), str("a"), str(typeRegular), str(""), str(tokenEnd)), "is not sorted"},
+		"bad padding": {concat(str(magic), str(typeRegular), []byte{1, 0, 0, 0, 0, 0, 0, 0, 'a', 1, 0, 0, 0, 0, 0, 0}), "padding is not zero"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := Restore(bytes.NewReader(tt.archive), filepath.Join(t.TempDir(), "out"))
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tt.err)
+			}
+		})
+	}
+}
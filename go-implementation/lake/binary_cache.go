@@ -0,0 +1,398 @@
+package lake
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/maxmcd/lake/go-implementation/archive"
+	"github.com/pkg/errors"
+)
+
+var (
+	// SubstitutersEnvVar holds a space separated list of binary cache urls
+	// that are queried for store outputs before they are built
+	SubstitutersEnvVar = "LAKE_SUBSTITUTERS"
+)
+
+// NarInfo describes a store output that has been uploaded to a binary cache.
+// It's stored next to the archive as <hash>.narinfo.
+type NarInfo struct {
+	// StorePath is the hash of the store output, for a store with only out
+	// it is the hash of the recipe that was built
+	StorePath string
+	// StoreDir is the store directory the output was built in. Outputs can
+	// contain absolute paths to themselves and their references so they can
+	// only be substituted into a store at the same location.
+	StoreDir string
+	// URL is the location of the archive relative to the cache root
+	URL         string
+	Compression string
+	// FileHash is the sha256 of the compressed archive and FileSize its size
+	// in bytes
+	FileHash string
+	FileSize int64
+	// NarHash is the content hash of the output, the sha256 of its
+	// uncompressed archive, and NarSize is the archive's size in bytes
+	NarHash string
+	NarSize int64
+	// References are the hashes of other store outputs that this output
+	// contains paths to
+	References []string
+	// Sigs are signatures of the narinfo's fingerprint, see NarInfo.Sign
+	Sigs []string
+}
+
+// MarshalText encodes the narinfo as "Key: value" lines
+func (info NarInfo) MarshalText() ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "StorePath: %s\n", info.StorePath)
+	fmt.Fprintf(&buf, "StoreDir: %s\n", info.StoreDir)
+	fmt.Fprintf(&buf, "URL: %s\n", info.URL)
+	fmt.Fprintf(&buf, "Compression: %s\n", info.Compression)
+	fmt.Fprintf(&buf, "FileHash: %s\n", info.FileHash)
+	fmt.Fprintf(&buf, "FileSize: %d\n", info.FileSize)
+	fmt.Fprintf(&buf, "NarHash: %s\n", info.NarHash)
+	fmt.Fprintf(&buf, "NarSize: %d\n", info.NarSize)
+	fmt.Fprintf(&buf, "References: %s\n", strings.Join(info.References, " "))
+	for _, sig := range info.Sigs {
+		fmt.Fprintf(&buf, "Sig: %s\n", sig)
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalText decodes a narinfo encoded by MarshalText. Unknown keys are
+// ignored so that fields can be added.
+func (info *NarInfo) UnmarshalText(b []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), ": ")
+		if !found {
+			if strings.TrimSpace(scanner.Text()) == "" {
+				continue
+			}
+			return errors.Errorf("invalid narinfo line %q", scanner.Text())
+		}
+		switch key {
+		case "StorePath":
+			info.StorePath = value
+		case "StoreDir":
+			info.StoreDir = value
+		case "URL":
+			info.URL = value
+		case "Compression":
+			info.Compression = value
+		case "FileHash":
+			info.FileHash = value
+		case "FileSize":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return errors.Wrap(err, "invalid narinfo FileSize")
+			}
+			info.FileSize = size
+		case "NarHash":
+			info.NarHash = value
+		case "NarSize":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return errors.Wrap(err, "invalid narinfo NarSize")
+			}
+			info.NarSize = size
+		case "References":
+			info.References = strings.Fields(value)
+		case "Sig":
+			info.Sigs = append(info.Sigs, value)
+		}
+	}
+	if info.StorePath == "" || info.URL == "" || info.NarHash == "" {
+		return errors.New("narinfo is missing StorePath, URL or NarHash")
+	}
+	return scanner.Err()
+}
+
+// BinaryCache is a remote store that outputs can be substituted from instead of
+// being built, and that locally built outputs can be pushed to
+type BinaryCache interface {
+	// Get returns the contents of the file at path, found is false if it
+	// doesn't exist
+	Get(path string) (body io.ReadCloser, found bool, err error)
+	// Put uploads a file to path
+	Put(path string, body io.Reader) error
+	// String returns the url of the cache
+	String() string
+}
+
+// NewBinaryCache returns a binary cache for an http(s):// or file:// url
+func NewBinaryCache(rawURL string) (BinaryCache, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid binary cache url %q", rawURL)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return httpBinaryCache{url: strings.TrimSuffix(rawURL, "/"), client: http.DefaultClient}, nil
+	case "file":
+		return fileBinaryCache{dir: u.Path}, nil
+	}
+	return nil, errors.Errorf("unsupported binary cache url %q, must be http, https or file", rawURL)
+}
+
+type httpBinaryCache struct {
+	url    string
+	client *http.Client
+}
+
+func (c httpBinaryCache) String() string { return c.url }
+
+func (c httpBinaryCache) Get(path string) (io.ReadCloser, bool, error) {
+	resp, err := c.client.Get(c.url + "/" + path)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "error fetching %s/%s", c.url, path)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, true, nil
+	case http.StatusNotFound:
+		_ = resp.Body.Close()
+		return nil, false, nil
+	}
+	_ = resp.Body.Close()
+	return nil, false, errors.Errorf("error fetching %s/%s: %s", c.url, path, resp.Status)
+}
+
+func (c httpBinaryCache) Put(path string, body io.Reader) error {
+	req, err := http.NewRequest(http.MethodPut, c.url+"/"+path, body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "error uploading %s/%s", c.url, path)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("error uploading %s/%s: %s", c.url, path, resp.Status)
+	}
+	return nil
+}
+
+type fileBinaryCache struct {
+	dir string
+}
+
+func (c fileBinaryCache) String() string { return "file://" + c.dir }
+
+func (c fileBinaryCache) Get(path string) (io.ReadCloser, bool, error) {
+	f, err := os.Open(filepath.Join(c.dir, filepath.FromSlash(path)))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return f, true, nil
+}
+
+func (c fileBinaryCache) Put(path string, body io.Reader) error {
+	dst := filepath.Join(c.dir, filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(dst, b, 0644)
+}
+
+func narInfoPath(hash string) string { return hash + ".narinfo" }
+
+// fetchNarInfo returns the narinfo for hash from cache, found is false if the
+// cache doesn't have it
+func fetchNarInfo(cache BinaryCache, hash string) (info NarInfo, found bool, err error) {
+	body, found, err := cache.Get(narInfoPath(hash))
+	if err != nil || !found {
+		return NarInfo{}, found, err
+	}
+	defer body.Close()
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return NarInfo{}, false, errors.Wrapf(err, "error reading narinfo from %s", cache)
+	}
+	if err := info.UnmarshalText(b); err != nil {
+		return NarInfo{}, false, errors.Wrapf(err, "error parsing narinfo from %s", cache)
+	}
+	if info.StorePath != hash {
+		return NarInfo{}, false, errors.Errorf(
+			"narinfo from %s is for %s, expected %s", cache, info.StorePath, hash)
+	}
+	return info, true, nil
+}
+
+// downloadArchive downloads the archive described by info and extracts it to
+// outPath after verifying its size and hash
+func downloadArchive(cache BinaryCache, info NarInfo, outPath string) error {
+	if info.Compression != "gzip" {
+		return errors.Errorf("unsupported compression %q for %s", info.Compression, info.StorePath)
+	}
+	body, found, err := cache.Get(info.URL)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.Errorf("archive %s is missing from %s", info.URL, cache)
+	}
+	defer body.Close()
+
+	f, err := os.CreateTemp("", "lake-substitute-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), body)
+	if err != nil {
+		return errors.Wrapf(err, "error downloading %s from %s", info.URL, cache)
+	}
+	if size != info.FileSize {
+		return errors.Errorf("archive %s from %s is %d bytes, expected %d", info.URL, cache, size, info.FileSize)
+	}
+	if got := "sha256:" + bytesToBase32Hash(h.Sum(nil)); got != info.FileHash {
+		return errors.Errorf("archive %s from %s has hash %s, expected %s", info.URL, cache, got, info.FileHash)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	// Restore next to the output and rename so that a failed download never
+	// leaves a partial output behind
+	tmp, err := os.MkdirTemp(filepath.Dir(outPath), ".tmp-"+filepath.Base(outPath))
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return errors.Wrapf(err, "error decompressing %s", info.URL)
+	}
+	narHash := sha256.New()
+	counter := &countingWriter{w: narHash}
+	dst := filepath.Join(tmp, "out")
+	if err := archive.Restore(io.TeeReader(gz, counter), dst); err != nil {
+		return errors.Wrapf(err, "error restoring %s", info.URL)
+	}
+	if counter.n != info.NarSize {
+		return errors.Errorf("archive %s from %s is %d bytes uncompressed, expected %d",
+			info.URL, cache, counter.n, info.NarSize)
+	}
+	if got := "sha256:" + bytesToBase32Hash(narHash.Sum(nil)); got != info.NarHash {
+		return errors.Errorf("output in %s from %s has hash %s, expected %s", info.URL, cache, got, info.NarHash)
+	}
+	return os.Rename(dst, outPath)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
+
+// uploadOutput archives the output at outPath and uploads it to cache along
+// with its narinfo, signed by key if it isn't nil. The archive must match
+// outputHash, the content hash that was recorded when the output was built.
+func uploadOutput(cache BinaryCache, hash, storeDir, outPath, outputHash string, references []string, key *SecretKey) error {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	narHash := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(gz, narHash)}
+	if err := archive.Dump(counter, outPath); err != nil {
+		return errors.Wrapf(err, "error archiving %s", outPath)
+	}
+	if err := gz.Close(); err != nil {
+		return errors.Wrapf(err, "error archiving %s", outPath)
+	}
+	if got := "sha256:" + bytesToBase32Hash(narHash.Sum(nil)); got != outputHash {
+		return errors.Errorf("output %s has been modified since it was built, it has hash %s, expected %s",
+			outPath, got, outputHash)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	info := NarInfo{
+		StorePath:   hash,
+		StoreDir:    storeDir,
+		URL:         "archive/" + hash + ".lar.gz",
+		Compression: "gzip",
+		FileHash:    "sha256:" + bytesToBase32Hash(sum[:]),
+		FileSize:    int64(buf.Len()),
+		NarHash:     outputHash,
+		NarSize:     counter.n,
+		References:  references,
+	}
+	if key != nil {
+		info.Sign(*key)
+	}
+	if err := cache.Put(info.URL, &buf); err != nil {
+		return err
+	}
+	// Upload the narinfo last so that it never points to a missing archive
+	b, _ := info.MarshalText()
+	return cache.Put(narInfoPath(hash), bytes.NewReader(b))
+}
+
+// scanReferences returns the hashes in candidates that appear anywhere in the
+// files, symlinks or names within dir
+func scanReferences(dir string, candidates []string) (found []string, err error) {
+	remaining := map[string]struct{}{}
+	for _, hash := range candidates {
+		remaining[hash] = struct{}{}
+	}
+	check := func(b []byte) {
+		for hash := range remaining {
+			if bytes.Contains(b, []byte(hash)) {
+				delete(remaining, hash)
+			}
+		}
+	}
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || len(remaining) == 0 {
+			return err
+		}
+		check([]byte(d.Name()))
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			check([]byte(target))
+		case d.Type().IsRegular():
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			check(b)
+		}
+		return nil
+	})
+	for _, hash := range candidates {
+		if _, missing := remaining[hash]; !missing {
+			found = append(found, hash)
+		}
+	}
+	return found, err
+}
@@ -0,0 +1,266 @@
+package lake
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryCacheServer is an http binary cache that keeps uploads in memory
+type memoryCacheServer struct {
+	lock  sync.Mutex
+	files map[string][]byte
+}
+
+func (s *memoryCacheServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		b, found := s.files[r.URL.Path]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(b)
+	case http.MethodPut:
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.files[r.URL.Path] = b
+	}
+}
+
+func TestNarInfoText(t *testing.T) {
+	info := NarInfo{
+		StorePath:   "525zavu5llf5gyfyq73x5mys6mrs7vha",
+		StoreDir:    "/lake/store",
+		URL:         "archive/525zavu5llf5gyfyq73x5mys6mrs7vha.tar.gz",
+		Compression: "gzip",
+		FileHash:    "sha256:icpfggjznz3jxnctxtcky55g7zhbsk4u",
+		FileSize:    1024,
+		NarHash:     "sha256:x3bfvtwq47ykpkojrojsz2cmcf4w4egb",
+		NarSize:     4096,
+		References:  []string{"a4ckr4xvftvmjb4brrixkxuhevvmwt5p"},
+	}
+	b, err := info.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded NarInfo
+	if err := decoded.UnmarshalText(b); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, info, decoded)
+}
+
+// substituteTestPackage returns a builder for a package where "b" references
+// "a" in its output. Each time a store is built a line is appended to the
+// returned log file.
+func substituteTestPackage(t *testing.T) (*LocalBuilder, map[string]Value, string) {
+	log := filepath.Join(t.TempDir(), "log")
+	builder, values := parseTestPackage(t, `
+store "a" {
+  script = "echo a >> `+log+` && echo a > $out/a"
+}
+store "b" {
+  inputs = [a]
+  script = "echo b >> `+log+` && echo $a > $out/ref"
+}
+`)
+	return builder, values, log
+}
+
+func removeOutputs(t *testing.T, builder *LocalBuilder, values map[string]Value) {
+	for _, value := range values {
+		if recipe, found := value.Recipe(); found {
+			if err := os.RemoveAll(builder.store.OutputPath(recipe.Hash())); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestSubstituteHTTP(t *testing.T) {
+	server := httptest.NewServer(&memoryCacheServer{files: map[string][]byte{}})
+	defer server.Close()
+	cache, err := NewBinaryCache(server.URL + "/cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	builder, values, log := substituteTestPackage(t)
+	secret, public, err := GenerateKey("test-cache-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder.SigningKey = &secret
+	path := buildTestRecipe(t, builder, values, "b")
+	b, _ := values["b"].Recipe()
+	if err := builder.Push(cache, b); err != nil {
+		t.Fatal(err)
+	}
+	a, _ := values["a"].Recipe()
+	info, found, err := fetchNarInfo(cache, b.Hash())
+	if err != nil || !found {
+		t.Fatal(found, err)
+	}
+	assert.Equal(t, []string{a.Hash()}, info.References)
+	outputHash, err := builder.store.OutputHash(b.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, outputHash, info.NarHash)
+
+	removeOutputs(t, builder, values)
+	builder.Substituters = []BinaryCache{cache}
+	builder.TrustedKeys = []PublicKey{public}
+	assert.Equal(t, path, buildTestRecipe(t, builder, values, "b"))
+	// The reference was substituted along with the output
+	assert.FileExists(t, filepath.Join(builder.store.OutputPath(a.Hash()), "a"))
+	assert.FileExists(t, filepath.Join(path, "ref"))
+
+	logContents, _ := os.ReadFile(log)
+	assert.Equal(t, "a\nb\n", string(logContents), "stores were rebuilt instead of substituted")
+	substitutedHash, err := builder.store.OutputHash(b.Hash())
+	assert.NoError(t, err)
+	assert.Equal(t, outputHash, substitutedHash)
+}
+
+func TestPushModifiedOutput(t *testing.T) {
+	cache, err := NewBinaryCache("file://" + t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder, values, _ := substituteTestPackage(t)
+	path := buildTestRecipe(t, builder, values, "a")
+	if err := os.WriteFile(filepath.Join(path, "a"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	a, _ := values["a"].Recipe()
+	err = builder.Push(cache, a)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "has been modified since it was built")
+	}
+}
+
+func TestSubstituteFallsBackToBuilding(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewBinaryCache("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder, values, log := substituteTestPackage(t)
+	secret, public, err := GenerateKey("test-cache-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder.SigningKey = &secret
+	builder.TrustedKeys = []PublicKey{public}
+	buildTestRecipe(t, builder, values, "a")
+	a, _ := values["a"].Recipe()
+	if err := builder.Push(cache, a); err != nil {
+		t.Fatal(err)
+	}
+	// Corrupt the archive
+	archive := filepath.Join(dir, "archive", a.Hash()+".lar.gz")
+	if err := os.WriteFile(archive, []byte("not a tarball"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	removeOutputs(t, builder, values)
+	var stderr, progress bytes.Buffer
+	builder.Stderr = &stderr
+	builder.Progress = NewLineProgress(io.Discard, &progress)
+	builder.Substituters = []BinaryCache{cache}
+	buildTestRecipe(t, builder, values, "a")
+	assert.Contains(t, stderr.String(), "warning: error substituting")
+	logContents, _ := os.ReadFile(log)
+	assert.Equal(t, 2, strings.Count(string(logContents), "a\n"))
+	// The failed download is finished before the build starts
+	assert.Contains(t, progress.String(), "failed a after")
+	assert.Equal(t, 2, strings.Count(progress.String(), "building a\n"))
+}
+
+func TestSubstituteRequiresTrustedSignature(t *testing.T) {
+	trusted, trustedPublic, err := GenerateKey("trusted-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	untrusted, _, err := GenerateKey("untrusted-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		key     *SecretKey
+		tamper  func(info *NarInfo)
+		warning string
+	}{
+		{name: "unsigned", warning: "is not signed"},
+		{name: "untrusted key", key: &untrusted, warning: "no valid signature from a trusted key"},
+		{
+			name: "tampered narinfo",
+			key:  &trusted,
+			tamper: func(info *NarInfo) {
+				info.References = append(info.References, "a4ckr4xvftvmjb4brrixkxuhevvmwt5p")
+			},
+			warning: "no valid signature from a trusted key",
+		},
+		{
+			name: "forged signature name",
+			key:  &untrusted,
+			tamper: func(info *NarInfo) {
+				info.Sigs[0] = "trusted-1" + info.Sigs[0][len("untrusted-1"):]
+			},
+			warning: "no valid signature from a trusted key",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cache, err := NewBinaryCache("file://" + dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			builder, values, log := substituteTestPackage(t)
+			builder.SigningKey = tt.key
+			buildTestRecipe(t, builder, values, "a")
+			a, _ := values["a"].Recipe()
+			if err := builder.Push(cache, a); err != nil {
+				t.Fatal(err)
+			}
+			if tt.tamper != nil {
+				info, _, err := fetchNarInfo(cache, a.Hash())
+				if err != nil {
+					t.Fatal(err)
+				}
+				tt.tamper(&info)
+				b, _ := info.MarshalText()
+				if err := cache.Put(narInfoPath(a.Hash()), bytes.NewReader(b)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			removeOutputs(t, builder, values)
+			var stderr bytes.Buffer
+			builder.Stderr = &stderr
+			builder.Substituters = []BinaryCache{cache}
+			builder.TrustedKeys = []PublicKey{trustedPublic}
+			buildTestRecipe(t, builder, values, "a")
+			assert.Contains(t, stderr.String(), tt.warning)
+			logContents, _ := os.ReadFile(log)
+			assert.Equal(t, "a\na\n", string(logContents), "store was substituted")
+		})
+	}
+}
@@ -0,0 +1,1098 @@
+package lake
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultShell is used to run scripts for recipes that don't set a shell and
+// have no config shell to fall back to
+var defaultShell = []string{"/bin/sh"}
+
+// buildHome is the value of $HOME in builds, it intentionally doesn't exist
+var buildHome = "/homeless"
+
+// Builder builds recipes and returns the location of their output, for targets
+// it's the path of an executable that runs the target. A build stops when ctx
+// is cancelled.
+type Builder interface {
+	Build(ctx context.Context, recipe Recipe) (outPath string, err error)
+}
+
+var _ Builder = (*LocalBuilder)(nil)
+
+// LocalBuilder builds store recipes and their dependencies on this machine
+// into a Store
+type LocalBuilder struct {
+	store     Store
+	workspace *Workspace
+
+	// Substituters are queried in order for prebuilt store outputs before a
+	// store is built
+	Substituters []BinaryCache
+	// TrustedKeys are the keys substituted outputs must be signed by, nothing
+	// is substituted if it's empty
+	TrustedKeys []PublicKey
+	// SigningKey signs outputs that are pushed, they're pushed unsigned if
+	// it's nil
+	SigningKey *SecretKey
+
+	// Progress is told about each store as it's built. If it's nil the output
+	// of builds is written to Stdout and Stderr with each line prefixed by the
+	// name of the recipe. The full output of each build is also written to its
+	// log in the store.
+	Progress Progress
+
+	Stdout io.Writer
+	Stderr io.Writer
+
+	progressOnce sync.Once
+	// planned holds the hashes of recipes that have been counted by plan
+	planned map[string]struct{}
+}
+
+// NewLocalBuilder returns a builder that writes outputs to store and resolves
+// recipe references through workspace
+func NewLocalBuilder(store Store, workspace *Workspace) *LocalBuilder {
+	return &LocalBuilder{
+		store:     store,
+		workspace: workspace,
+		Stdout:    os.Stdout,
+		Stderr:    os.Stderr,
+	}
+}
+
+// Build builds a store recipe, building any recipes it references first, and
+// returns the location of its output, for stores with more than one output
+// it's the location of out. Stores that have already been built are not
+// rebuilt. Targets are materialized as an executable wrapper and the path of
+// the wrapper is returned.
+//
+// Only one process builds a recipe at a time, others wait for the build to
+// finish and then use its output.
+func (b *LocalBuilder) Build(ctx context.Context, recipe Recipe) (outPath string, err error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if recipe.System != "" && recipe.System != HostSystem() {
+		return "", errors.Errorf(
+			"%q is for system %q and can't be built on this %q host",
+			recipe.Name, recipe.System, HostSystem())
+	}
+	b.plan(recipe)
+	if !recipe.IsStore {
+		return b.materializeTarget(ctx, recipe)
+	}
+	outPath = b.store.OutputPath(recipe.Hash())
+	if missing, err := b.missingOutputs(recipe); err != nil || len(missing) == 0 {
+		return outPath, err
+	}
+	unlock, err := b.lock(ctx, recipe)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	// Another process might have built it while we waited for the lock
+	missing, err := b.missingOutputs(recipe)
+	if err != nil || len(missing) == 0 {
+		return outPath, err
+	}
+	if substituted, err := b.substitute(ctx, recipe, missing); err != nil || substituted {
+		return outPath, err
+	}
+	// The outputs are built together. Outputs that are already valid, eg: one
+	// that was substituted on its own, might be referenced by other outputs so
+	// they're set aside while the store is built and put back afterwards, only
+	// the missing outputs are replaced by the build.
+	rebuild := map[string]bool{}
+	for _, output := range missing {
+		rebuild[output.hash] = true
+	}
+	defer func() {
+		for _, output := range recipe.outputs() {
+			if rebuild[output.hash] {
+				continue
+			}
+			if restoreErr := b.store.RestorePath(output.hash); restoreErr != nil && err == nil {
+				err = errors.Wrapf(restoreErr, "error restoring the output of %q", recipe.Name)
+			}
+		}
+	}()
+	for _, output := range recipe.outputs() {
+		if rebuild[output.hash] {
+			// Anything at the path is left over from a build that didn't finish
+			if err := b.store.InvalidatePath(output.hash); err != nil {
+				return "", err
+			}
+		} else if _, err := b.store.SetAside(output.hash); err != nil {
+			return "", errors.Wrapf(err, "error building %q", recipe.Name)
+		}
+	}
+	started := time.Now()
+	if err := b.buildOutput(ctx, recipe, b.store.LogPath(recipe.Hash())); err != nil {
+		return "", err
+	}
+	for _, output := range missing {
+		if err := b.registerOutput(recipe, output, started, ""); err != nil {
+			for _, output := range missing {
+				_ = b.store.InvalidatePath(output.hash)
+			}
+			return "", err
+		}
+	}
+	return outPath, nil
+}
+
+// buildReference builds what hash references and returns its location. A
+// reference to one output of a store only needs that output, and whatever it
+// references, so it's substituted on its own when it can be.
+func (b *LocalBuilder) buildReference(ctx context.Context, hash string) (path string, err error) {
+	dependency, found := b.workspace.Recipe(hash)
+	if !found {
+		return "", errors.Errorf("unknown recipe %s", hash)
+	}
+	if !dependency.IsStore || len(dependency.Outputs) == 0 {
+		return b.Build(ctx, dependency)
+	}
+	path = b.store.OutputPath(hash)
+	if _, valid, err := b.store.QueryPath(hash); err != nil || valid {
+		return path, err
+	}
+	substituted, err := func() (bool, error) {
+		if len(b.Substituters) == 0 || dependency.System != HostSystem() {
+			return false, nil
+		}
+		b.plan(dependency)
+		unlock, err := b.lock(ctx, dependency)
+		if err != nil {
+			return false, err
+		}
+		defer unlock()
+		if _, valid, err := b.store.QueryPath(hash); err != nil || valid {
+			return valid, err
+		}
+		for _, output := range dependency.outputs() {
+			if output.hash == hash {
+				return b.substitute(ctx, dependency, []recipeOutput{output})
+			}
+		}
+		return false, nil
+	}()
+	if err != nil || substituted {
+		return path, err
+	}
+	if _, err := b.Build(ctx, dependency); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// missingOutputs returns the outputs of a store that aren't valid
+func (b *LocalBuilder) missingOutputs(recipe Recipe) (missing []recipeOutput, err error) {
+	for _, output := range recipe.outputs() {
+		_, valid, err := b.store.QueryPath(output.hash)
+		if err != nil {
+			return nil, err
+		}
+		if !valid {
+			missing = append(missing, output)
+		}
+	}
+	return missing, nil
+}
+
+// outputPaths returns the location of each of a store's outputs by name
+func (b *LocalBuilder) outputPaths(recipe Recipe) map[string]string {
+	paths := map[string]string{}
+	for _, output := range recipe.outputs() {
+		paths[output.name] = b.store.OutputPath(output.hash)
+	}
+	return paths
+}
+
+// lock takes the store's lock for building recipe, telling the user if
+// another process is building it. Outputs left set aside by a process that
+// was killed while checking the recipe are restored.
+func (b *LocalBuilder) lock(ctx context.Context, recipe Recipe) (unlock func() error, err error) {
+	unlock, err = b.store.LockPath(ctx, recipe.Hash(), func() {
+		fmt.Fprintf(b.Stderr, "waiting for another process to finish building %q\n", recipe.Name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, output := range recipe.outputs() {
+		if err := b.store.RestorePath(output.hash); err != nil {
+			_ = unlock()
+			return nil, err
+		}
+	}
+	return unlock, nil
+}
+
+// registerOutput records the output hash and references of an output of a
+// store that has just been built and marks it as valid. An output can
+// reference the store's other outputs as well as the store's dependencies.
+func (b *LocalBuilder) registerOutput(recipe Recipe, output recipeOutput, started time.Time, substituter string) error {
+	hash := output.hash
+	outPath := b.store.OutputPath(hash)
+	outputHash, err := b.store.OutputHash(hash)
+	if os.IsNotExist(errors.Cause(err)) {
+		outputHash, err = b.store.WriteOutputHash(hash)
+	}
+	if err != nil {
+		return err
+	}
+	candidates := recipe.references()
+	name := recipe.Name
+	for _, sibling := range recipe.outputs() {
+		if sibling.hash != hash {
+			candidates = append(candidates, sibling.hash)
+		} else if sibling.name != defaultOutput {
+			name += "." + sibling.name
+		}
+	}
+	references, err := scanReferences(outPath, candidates)
+	if err != nil {
+		return errors.Wrapf(err, "error scanning %q for references", name)
+	}
+	return b.store.RegisterPath(PathInfo{
+		Hash:         hash,
+		Name:         name,
+		Derivation:   b.store.DerivationPath(recipe.Hash()),
+		References:   references,
+		OutputHash:   outputHash,
+		RegisteredAt: time.Now().UTC(),
+		BuildTime:    time.Since(started),
+		Substituter:  substituter,
+	})
+}
+
+// buildOutput runs the recipe's script, or fetches its url, with each output's
+// path set by name, eg: $out. The outputs are removed if the build fails, is
+// cancelled or runs for longer than the recipe's timeout. What the build
+// prints is logged to logPath.
+func (b *LocalBuilder) buildOutput(ctx context.Context, recipe Recipe, logPath string) (err error) {
+	resolved, inputs, err := b.resolveReferences(ctx, recipe)
+	if err != nil {
+		return err
+	}
+	if err := b.store.WriteDerivation(recipe.Derivation()); err != nil {
+		return err
+	}
+
+	unlock, err := b.LockCacheDirectories(recipe)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if resolved, err = b.replaceCacheDirectory(resolved); err != nil {
+		return err
+	}
+
+	buildCtx := ctx
+	var timeout time.Duration
+	if recipe.Timeout != "" {
+		if timeout, err = time.ParseDuration(recipe.Timeout); err != nil {
+			return errors.Wrapf(err, "invalid timeout for %q", recipe.Name)
+		}
+		var cancel context.CancelFunc
+		buildCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	progress := b.progress()
+	progress.Started(recipe)
+	defer func() { progress.Finished(recipe, err) }()
+	log, err := createLog(logPath)
+	if err != nil {
+		return err
+	}
+	outputs := b.outputPaths(recipe)
+	for _, path := range outputs {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			_ = log.Close()
+			return errors.Wrapf(err, "error creating output directory for %q", recipe.Name)
+		}
+	}
+	if resolved.isFetcher() {
+		fmt.Fprintf(log, "fetching %s\n", resolved.Env["url"])
+		err = fetch(buildCtx, resolved, outputs[defaultOutput])
+	} else {
+		stdout := &lineWriter{emit: func(line string) { progress.Output(recipe, line, false) }}
+		stderr := &lineWriter{emit: func(line string) { progress.Output(recipe, line, true) }}
+		err = b.runScript(buildCtx, resolved, inputs, outputs,
+			io.MultiWriter(log, stdout), io.MultiWriter(log, stderr))
+		stdout.Flush()
+		stderr.Flush()
+	}
+	if err != nil && ctx.Err() == nil && buildCtx.Err() == context.DeadlineExceeded {
+		err = errors.Errorf("timed out after %s", timeout)
+	}
+	if err != nil {
+		fmt.Fprintf(log, "error: %v\n", err)
+	}
+	if logErr := log.Close(); err == nil {
+		err = logErr
+	}
+	if err != nil {
+		for _, path := range outputs {
+			_ = os.RemoveAll(path)
+		}
+		return errors.Wrapf(err, "error building %q", recipe.Name)
+	}
+	return nil
+}
+
+func (b *LocalBuilder) progress() Progress {
+	b.progressOnce.Do(func() {
+		if b.Progress == nil {
+			b.Progress = &outputProgress{stdout: b.Stdout, stderr: b.Stderr}
+		}
+	})
+	return b.Progress
+}
+
+// plan tells the progress how many stores will be built or substituted to
+// build recipe. Recipes are only counted once so nested calls from building
+// dependencies don't add to the total.
+func (b *LocalBuilder) plan(recipe Recipe) {
+	if b.planned == nil {
+		b.planned = map[string]struct{}{}
+	}
+	var count int
+	var walk func(recipe Recipe)
+	walk = func(recipe Recipe) {
+		hash := recipe.Hash()
+		if _, found := b.planned[hash]; found {
+			return
+		}
+		b.planned[hash] = struct{}{}
+		if recipe.IsStore {
+			if missing, _ := b.missingOutputs(recipe); len(missing) == 0 {
+				return
+			}
+			count++
+		}
+		for _, reference := range recipe.references() {
+			if dependency, found := b.workspace.Recipe(reference); found {
+				walk(dependency)
+			}
+		}
+	}
+	walk(recipe)
+	if count > 0 {
+		b.progress().Planned(count)
+	}
+}
+
+// substitute downloads outputs of a store from the first substituter that has
+// them. Outputs of the store that they reference are downloaded with them.
+// Substituters that fail are skipped with a warning so that the outputs can
+// still be built locally. The recipe's lock should be held.
+func (b *LocalBuilder) substitute(ctx context.Context, recipe Recipe, outputs []recipeOutput) (substituted bool, err error) {
+	siblings := map[string]recipeOutput{}
+	for _, output := range recipe.outputs() {
+		siblings[output.hash] = output
+	}
+	for _, cache := range b.Substituters {
+		infos, found := b.fetchNarInfos(cache, recipe, outputs, siblings)
+		if !found {
+			continue
+		}
+		// The outputs might contain paths to their references, they must be
+		// present before they are
+		for _, info := range infos {
+			for _, reference := range info.References {
+				if _, sibling := siblings[reference]; sibling {
+					continue
+				}
+				if _, found := b.workspace.Recipe(reference); !found {
+					return false, errors.Errorf(
+						"%s has %q referencing unknown recipe %s", cache, recipe.Name, reference)
+				}
+				if _, err := b.buildReference(ctx, reference); err != nil {
+					return false, err
+				}
+			}
+		}
+		if err := b.store.WriteDerivation(recipe.Derivation()); err != nil {
+			return false, err
+		}
+		started := time.Now()
+		b.progress().Started(recipe)
+		if err := b.downloadOutputs(cache, infos); err != nil {
+			fmt.Fprintf(b.Stderr, "warning: error substituting %q: %v\n", recipe.Name, err)
+			b.progress().Finished(recipe, err)
+			continue
+		}
+		for _, info := range infos {
+			if err = b.registerOutput(recipe, siblings[info.StorePath], started, cache.String()); err != nil {
+				for _, info := range infos {
+					_ = b.store.InvalidatePath(info.StorePath)
+				}
+				break
+			}
+		}
+		b.progress().Finished(recipe, err)
+		return true, err
+	}
+	return false, nil
+}
+
+// fetchNarInfos returns the narinfo of each output from cache along with those
+// of the outputs they reference that aren't valid. found is false if the
+// cache doesn't have all of them or they can't be used.
+func (b *LocalBuilder) fetchNarInfos(cache BinaryCache, recipe Recipe, outputs []recipeOutput, siblings map[string]recipeOutput) (infos []NarInfo, found bool) {
+	queue := append([]recipeOutput{}, outputs...)
+	queued := map[string]struct{}{}
+	for _, output := range outputs {
+		queued[output.hash] = struct{}{}
+	}
+	for ; len(queue) > 0; queue = queue[1:] {
+		info, found, err := fetchNarInfo(cache, queue[0].hash)
+		if err != nil {
+			fmt.Fprintf(b.Stderr, "warning: skipping substituter: %v\n", err)
+			return nil, false
+		}
+		if !found {
+			return nil, false
+		}
+		if err := info.verify(b.TrustedKeys); err != nil {
+			fmt.Fprintf(b.Stderr, "warning: refusing to substitute from %s: %v\n", cache, err)
+			return nil, false
+		}
+		if info.StoreDir != b.store.storeDir() {
+			fmt.Fprintf(b.Stderr, "warning: %s has %q built for store %s, not %s\n",
+				cache, recipe.Name, info.StoreDir, b.store.storeDir())
+			return nil, false
+		}
+		infos = append(infos, info)
+		for _, reference := range info.References {
+			sibling, isSibling := siblings[reference]
+			if _, done := queued[reference]; done || !isSibling {
+				continue
+			}
+			queued[reference] = struct{}{}
+			if _, valid, _ := b.store.QueryPath(reference); !valid {
+				queue = append(queue, sibling)
+			}
+		}
+	}
+	return infos, true
+}
+
+// downloadOutputs downloads the output described by each narinfo, nothing is
+// left behind if any of them fail
+func (b *LocalBuilder) downloadOutputs(cache BinaryCache, infos []NarInfo) (err error) {
+	for _, info := range infos {
+		// Anything at the output path is left over from a build that didn't
+		// finish
+		if err = b.store.InvalidatePath(info.StorePath); err == nil {
+			err = downloadArchive(cache, info, b.store.OutputPath(info.StorePath))
+		}
+		if err == nil {
+			// The download was checked against the narinfo's NarHash
+			err = writeFileAtomic(b.store.OutputHashPath(info.StorePath), []byte(info.NarHash+"\n"), 0444)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		for _, info := range infos {
+			_ = b.store.InvalidatePath(info.StorePath)
+		}
+	}
+	return err
+}
+
+// Push uploads the outputs of a store recipe to cache along with the outputs
+// of every store it depends on that have been built. Outputs already in the
+// cache are skipped.
+func (b *LocalBuilder) Push(cache BinaryCache, recipe Recipe) error {
+	if !recipe.IsStore {
+		return errors.Errorf("%q is a target, only stores can be pushed", recipe.Name)
+	}
+	if missing, err := b.missingOutputs(recipe); err != nil || len(missing) > 0 {
+		return errors.Errorf("%q hasn't been built", recipe.Name)
+	}
+	pushed := map[string]struct{}{}
+	var push func(recipe Recipe) error
+	push = func(recipe Recipe) error {
+		hash := recipe.Hash()
+		if _, done := pushed[hash]; done || !recipe.IsStore {
+			return nil
+		}
+		pushed[hash] = struct{}{}
+		for _, reference := range recipe.references() {
+			if dependency, found := b.workspace.Recipe(reference); found {
+				if err := push(dependency); err != nil {
+					return err
+				}
+			}
+		}
+		for _, output := range recipe.outputs() {
+			info, valid, err := b.store.QueryPath(output.hash)
+			if err != nil {
+				return err
+			}
+			if !valid {
+				continue
+			}
+			_, found, err := fetchNarInfo(cache, output.hash)
+			if err != nil {
+				return err
+			}
+			if found {
+				continue
+			}
+			if err := uploadOutput(cache, output.hash, b.store.storeDir(), b.store.OutputPath(output.hash),
+				info.OutputHash, info.References, b.SigningKey); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return push(recipe)
+}
+
+// resolveReferences builds every recipe that recipe references and returns a
+// copy of the recipe with the references replaced by output paths. The
+// locations of recipes that are listed in the recipe's inputs are returned by
+// name, generated stores and for_each recipes are left out as they can only be
+// referenced through the value that created them, as are targets whose names
+// can't be environment variables, like "./bbcopy". Outputs other than out are
+// named after the store and the output, eg: stdenv_lib.
+func (b *LocalBuilder) resolveReferences(ctx context.Context, recipe Recipe) (resolved Recipe, inputs map[string]string, err error) {
+	var oldnew []string
+	paths := map[string]string{}
+	for _, hash := range recipe.references() {
+		if _, found := b.workspace.Recipe(hash); !found {
+			return Recipe{}, nil, errors.Errorf("%q references unknown recipe %s", recipe.Name, hash)
+		}
+		path, err := b.buildReference(ctx, hash)
+		if err != nil {
+			return Recipe{}, nil, err
+		}
+		paths[hash] = path
+		oldnew = append(oldnew, referenceString(hash), path)
+	}
+
+	inputs = map[string]string{}
+	for _, input := range recipe.Inputs {
+		match := referenceRegexp.FindStringSubmatch(input)
+		if match == nil || match[0] != input {
+			continue
+		}
+		dependency, _ := b.workspace.Recipe(match[1])
+		name, bound := inputName(dependency, match[1])
+		if !bound {
+			continue
+		}
+		if path, found := inputs[name]; found && path != paths[match[1]] {
+			return Recipe{}, nil, errors.Errorf(
+				"%q has more than one input named %q, inputs are bound to environment variables by name and must be unique",
+				recipe.Name, name)
+		}
+		inputs[name] = paths[match[1]]
+	}
+	return recipe.replace(strings.NewReplacer(oldnew...)), inputs, nil
+}
+
+// inputName returns the name of the environment variable the output of
+// dependency with the given hash is bound to when it's used as an input, see
+// resolveReferences
+func inputName(dependency Recipe, hash string) (name string, bound bool) {
+	if dependency.generated || dependency.forEach {
+		return "", false
+	}
+	if _, reserved := reservedEnvNames[dependency.Name]; !dependency.IsStore &&
+		(reserved || !shellIdentifierRegexp.MatchString(dependency.Name)) {
+		return "", false
+	}
+	name = dependency.Name
+	for _, output := range dependency.outputs() {
+		if output.hash == hash && output.name != defaultOutput {
+			name += "_" + output.name
+		}
+	}
+	return name, true
+}
+
+// materializeTarget writes a target to the store so that it can be invoked
+// from another recipe. The target's script is stored next to an executable
+// wrapper that sets up the target's environment and store paths and then runs
+// the script with the target's shell. The wrapper is a POSIX shell script so
+// that it can be run from any shell, or exec'd directly, with the same result.
+func (b *LocalBuilder) materializeTarget(ctx context.Context, recipe Recipe) (wrapperPath string, err error) {
+	dir := b.store.OutputPath(recipe.Hash())
+	wrapperPath = filepath.Join(dir, "bin", filepath.Base(recipe.Name))
+	if _, err := os.Stat(wrapperPath); err == nil {
+		return wrapperPath, nil
+	}
+	unlock, err := b.lock(ctx, recipe)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	if _, err := os.Stat(wrapperPath); err == nil {
+		return wrapperPath, nil
+	}
+
+	resolved, inputs, err := b.resolveReferences(ctx, recipe)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err = b.replaceCacheDirectory(resolved); err != nil {
+		return "", err
+	}
+
+	// Write the target next to its store path and rename it into place so
+	// that a failure never leaves a partial target behind
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), ".tmp-"+filepath.Base(dir))
+	if err != nil {
+		return "", errors.Wrapf(err, "error creating store directory for %q", recipe.Name)
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.Mkdir(filepath.Join(tmp, "bin"), 0755); err != nil {
+		return "", errors.Wrapf(err, "error creating store directory for %q", recipe.Name)
+	}
+	scriptPath := filepath.Join(dir, "script")
+	if err := os.WriteFile(filepath.Join(tmp, "script"), []byte(resolved.Script), 0644); err != nil {
+		return "", errors.Wrapf(err, "error writing script for %q", recipe.Name)
+	}
+	wrapper := targetWrapper(resolved, inputs, scriptPath)
+	if err := os.WriteFile(filepath.Join(tmp, "bin", filepath.Base(wrapperPath)), []byte(wrapper), 0755); err != nil {
+		return "", errors.Wrapf(err, "error writing wrapper for %q", recipe.Name)
+	}
+	// A directory without a wrapper is left over from a failure before
+	// targets were written this way
+	if err := os.RemoveAll(dir); err != nil {
+		return "", errors.Wrapf(err, "error removing partial target %q", recipe.Name)
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return "", errors.Wrapf(err, "error writing target %q", recipe.Name)
+	}
+	return wrapperPath, nil
+}
+
+// replaceCacheDirectory replaces the cache directory placeholder in a resolved
+// recipe with the location of the recipe's cache directory without locking it,
+// see LockCacheDirectories
+func (b *LocalBuilder) replaceCacheDirectory(resolved Recipe) (Recipe, error) {
+	if !resolved.usesCacheDirectory() {
+		return resolved, nil
+	}
+	cacheDir, err := b.store.CacheDirectory(resolved.dir, resolved.Name)
+	if err != nil {
+		return Recipe{}, err
+	}
+	return resolved.replace(strings.NewReplacer(cacheDirectoryPlaceholder, cacheDir)), nil
+}
+
+func (recipe Recipe) usesCacheDirectory() bool {
+	return strings.Contains(strings.Join(recipe.strings(), ""), cacheDirectoryPlaceholder)
+}
+
+// LockCacheDirectories locks the cache directories that running recipe's
+// script uses, its own and those of the targets it can run. Store builds take
+// the locks themselves, they should be held while a target or the environment
+// from ShellEnv is used. The returned function releases the locks.
+func (b *LocalBuilder) LockCacheDirectories(recipe Recipe) (unlock func() error, err error) {
+	dirs := map[string]struct{}{}
+	seen := map[string]struct{}{}
+	var walk func(recipe Recipe) error
+	walk = func(recipe Recipe) error {
+		if _, found := seen[recipe.Hash()]; found {
+			return nil
+		}
+		seen[recipe.Hash()] = struct{}{}
+		if recipe.usesCacheDirectory() {
+			dir, err := b.store.CacheDirectory(recipe.dir, recipe.Name)
+			if err != nil {
+				return err
+			}
+			dirs[dir] = struct{}{}
+		}
+		for _, reference := range recipe.references() {
+			if dependency, found := b.workspace.Recipe(reference); found && !dependency.IsStore {
+				if err := walk(dependency); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(recipe); err != nil {
+		return nil, err
+	}
+	var unlocks []func() error
+	unlock = func() (err error) {
+		for _, unlock := range unlocks {
+			if unlockErr := unlock(); err == nil {
+				err = unlockErr
+			}
+		}
+		return err
+	}
+	// Always locked in the same order so that builds sharing caches can't
+	// deadlock
+	sorted := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	sort.Strings(sorted)
+	for _, dir := range sorted {
+		dirUnlock, err := lockCacheDirectory(dir)
+		if err != nil {
+			_ = unlock()
+			return nil, err
+		}
+		unlocks = append(unlocks, dirUnlock)
+	}
+	return unlock, nil
+}
+
+func targetWrapper(recipe Recipe, inputs map[string]string, scriptPath string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "#!%s\n", defaultShell[0])
+	for _, env := range []map[string]string{inputs, recipe.Env} {
+		for _, k := range sortedKeys(env) {
+			fmt.Fprintf(&sb, "export %s=%s\n", k, shellQuote(env[k]))
+		}
+	}
+	shell := recipe.Shell
+	if len(shell) == 0 {
+		shell = defaultShell
+	}
+	sb.WriteString("exec")
+	for _, arg := range append(shell, scriptPath) {
+		sb.WriteString(" " + shellQuote(arg))
+	}
+	sb.WriteString(" \"$@\"\n")
+	return sb.String()
+}
+
+// shellQuote single quotes a value for use in a POSIX shell script
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+func (b *LocalBuilder) runScript(ctx context.Context, recipe Recipe, inputs, outputs map[string]string, stdout, stderr io.Writer) error {
+	tmp, err := os.MkdirTemp("", "lake-build-")
+	if err != nil {
+		return errors.Wrap(err, "error creating build directory")
+	}
+	defer os.RemoveAll(tmp)
+
+	buildDir := filepath.Join(tmp, "build")
+	if err := os.Mkdir(buildDir, 0755); err != nil {
+		return errors.Wrap(err, "error creating build directory")
+	}
+	if err := copyLocalInputs(recipe, buildDir); err != nil {
+		return err
+	}
+	scriptPath := filepath.Join(tmp, "script")
+	if err := os.WriteFile(scriptPath, []byte(recipe.Script), 0644); err != nil {
+		return errors.Wrap(err, "error writing build script")
+	}
+
+	shell := recipe.Shell
+	if len(shell) == 0 {
+		shell = defaultShell
+	}
+	cmd := exec.Command(shell[0], append(shell[1:], scriptPath)...)
+	cmd.Dir = buildDir
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.Env = buildEnv(recipe, inputs, outputs)
+	startProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-done:
+		}
+	}()
+	err = cmd.Wait()
+	close(done)
+	// Nothing the script started outlives the build
+	killProcessGroup(cmd)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// buildEnv returns the environment for a store build. Nothing is inherited from
+// the host. Each input and output is bound to its store path by name, $PATH
+// holds the bin directory of every input that has one, and is empty if none
+// do, and $HOME points to a directory that doesn't exist. Values in the
+// recipe's env take precedence.
+func buildEnv(recipe Recipe, inputs, outputs map[string]string) (env []string) {
+	var dirs []string
+	for _, name := range sortedKeys(inputs) {
+		if dir := binDirectory(inputs[name]); dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	env = []string{"PATH=" + strings.Join(dirs, string(os.PathListSeparator)), "HOME=" + buildHome}
+	for _, name := range sortedKeys(outputs) {
+		env = append(env, name+"="+outputs[name])
+	}
+	for _, name := range sortedKeys(inputs) {
+		env = append(env, name+"="+inputs[name])
+	}
+	for _, name := range sortedKeys(recipe.Env) {
+		env = append(env, name+"="+recipe.Env[name])
+	}
+	return env
+}
+
+// binDirectory returns the directory of an input that holds its executables,
+// the bin directory of a store or the directory of a target's wrapper. It's
+// empty if the input has none.
+func binDirectory(path string) string {
+	fi, err := os.Stat(path)
+	if err == nil && !fi.IsDir() {
+		return filepath.Dir(path)
+	}
+	if fi, err := os.Stat(filepath.Join(path, "bin")); err == nil && fi.IsDir() {
+		return filepath.Join(path, "bin")
+	}
+	return ""
+}
+
+func sortedKeys(m map[string]string) (keys []string) {
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// copyLocalInputs copies the local file inputs of a store into the build
+// directory. Their contents are part of the store's hash, so a file that has
+// changed since the package was parsed fails the build.
+func copyLocalInputs(recipe Recipe, buildDir string) error {
+	for _, input := range sortedKeys(recipe.sources) {
+		src := filepath.Join(recipe.dir, input)
+		dst := filepath.Join(buildDir, input)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return errors.Wrapf(err, "error copying input %q", input)
+		}
+		if err := copyFile(src, dst); err != nil {
+			return errors.Wrapf(err, "error copying input %q", input)
+		}
+		hash, err := hashOutput(dst)
+		if err != nil {
+			return err
+		}
+		if hash != recipe.sources[input] {
+			return errors.Errorf("input %q of %q has changed since the package was parsed", input, recipe.Name)
+		}
+	}
+	return nil
+}
+
+// localInputPatterns returns the inputs of a recipe that are files in its
+// package directory, they start with "./" and can be glob patterns
+func (recipe Recipe) localInputPatterns() (patterns []string) {
+	for _, input := range recipe.Inputs {
+		if strings.HasPrefix(input, "./") {
+			patterns = append(patterns, input)
+		}
+	}
+	return patterns
+}
+
+// localInputs returns the files in the package directory that a recipe uses
+// as inputs, relative to the directory and with glob patterns expanded
+func (recipe Recipe) localInputs() (inputs []string, err error) {
+	for _, pattern := range recipe.localInputPatterns() {
+		if !strings.ContainsAny(pattern, `*?[\`) {
+			inputs = append(inputs, pattern)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(recipe.dir, pattern))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid input pattern %q", pattern)
+		}
+		for _, match := range matches {
+			rel, err := filepath.Rel(recipe.dir, match)
+			if err != nil {
+				return nil, err
+			}
+			inputs = append(inputs, "./"+rel)
+		}
+	}
+	return inputs, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func (recipe Recipe) isFetcher() bool {
+	return recipe.Env["fetch_url"] == "true"
+}
+
+// fetch is the builtin fetcher. It downloads the recipe's url into the output
+// directory, verifying the download against the recipe's hash if it has one.
+// Gzipped tarballs are extracted.
+func fetch(ctx context.Context, recipe Recipe, outPath string) error {
+	url := recipe.Env["url"]
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return errors.Wrapf(err, "error fetching %q", url)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "error fetching %q", url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("error fetching %q: %s", url, resp.Status)
+	}
+
+	f, err := os.CreateTemp("", "lake-fetch-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), resp.Body); err != nil {
+		return errors.Wrapf(err, "error fetching %q", url)
+	}
+	if expected := recipe.Env["hash"]; expected != "" {
+		if got := bytesToBase32Hash(h.Sum(nil)); got != expected {
+			return errors.Errorf("hash mismatch fetching %q: expected %s, got %s", url, expected, got)
+		}
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(url, ".tar.gz") || strings.HasSuffix(url, ".tgz") {
+		return extractTarGz(f, outPath)
+	}
+	out, err := os.OpenFile(filepath.Join(outPath, filepath.Base(url)), os.O_CREATE|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, f); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func extractTarGz(r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, hdr.Name)
+		if !strings.HasPrefix(path, filepath.Clean(dir)+string(os.PathSeparator)) {
+			return errors.Errorf("tarball entry %q is outside of the output directory", hdr.Name)
+		}
+		if err := checkNoSymlinks(dir, path); err != nil {
+			return errors.Wrapf(err, "tarball entry %q", hdr.Name)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, path); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				_ = f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// checkNoSymlinks returns an error if path, or any directory between dir and
+// path, is a symlink. Extracting through a symlink that an earlier entry
+// created could write outside of dir.
+func checkNoSymlinks(dir, path string) error {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return err
+	}
+	current := filepath.Clean(dir)
+	for _, part := range strings.Split(rel, string(os.PathSeparator)) {
+		current = filepath.Join(current, part)
+		fi, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return errors.Errorf("%q is a symlink, entries can't be extracted through it", current)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,493 @@
+package lake
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// parseTestPackage writes src to a Lakefile in a temporary directory and
+// returns the parsed values along with a builder that uses a temporary store
+func parseTestPackage(t *testing.T, src string) (*LocalBuilder, map[string]Value) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, LakeFilename), []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ws := NewWorkspace(dir)
+	values, pkg, diags := ws.ParseDirectory(dir)
+	if diags.HasErrors() {
+		_ = PrintDiagnostics(pkg.FileMap(), diags)
+		t.Fatal(diags)
+	}
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewLocalBuilder(store, ws), values
+}
+
+func buildTestRecipe(t *testing.T, builder *LocalBuilder, values map[string]Value, name string) string {
+	t.Helper()
+	recipe, found := values[name].Recipe()
+	if !found {
+		t.Fatalf("no recipe named %q", name)
+	}
+	path, err := builder.Build(context.Background(), recipe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBuildReferences(t *testing.T) {
+	builder, values := parseTestPackage(t, `
+store "a" {
+  script = "echo a > $out/a"
+}
+store "b" {
+  script = "test -f ${a}/a && echo b > $out/b"
+}
+`)
+	path := buildTestRecipe(t, builder, values, "b")
+	assert.FileExists(t, filepath.Join(path, "b"))
+	a, _ := values["a"].Recipe()
+	assert.DirExists(t, builder.store.OutputPath(a.Hash()))
+}
+
+func TestBuildCacheDirectory(t *testing.T) {
+	builder, values := parseTestPackage(t, `
+store "go_binary" {
+  env    = { CACHE_DIR = cache_directory() }
+  script = "echo warm > $CACHE_DIR/state"
+}
+`)
+	recipe, _ := values["go_binary"].Recipe()
+	// The cache location doesn't take part in the hash
+	assert.Equal(t, cacheDirectoryPlaceholder, recipe.Env["CACHE_DIR"])
+	buildTestRecipe(t, builder, values, "go_binary")
+
+	cacheDir, err := builder.store.CacheDirectory(recipe.Dir(), "go_binary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.FileExists(t, filepath.Join(cacheDir, "state"))
+
+	// A different recipe with the same name sees the same cache
+	recipe.Script = "test -f $CACHE_DIR/state && echo ok > $out/ok"
+	path, err := builder.Build(context.Background(), recipe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.FileExists(t, filepath.Join(path, "ok"))
+
+	// A recipe with the same name in another package doesn't
+	other := recipe
+	other.dir = t.TempDir()
+	other.Script = "test ! -e $CACHE_DIR/state && echo ok > $out/ok"
+	if _, err := builder.Build(context.Background(), other); err != nil {
+		t.Fatal(err)
+	}
+	otherCacheDir, _ := builder.store.CacheDirectory(other.Dir(), "go_binary")
+	assert.NotEqual(t, cacheDir, otherCacheDir)
+
+	if err := builder.store.CleanCache("go_binary"); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{cacheDir, otherCacheDir} {
+		_, err = os.Stat(dir)
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	// Names that are paths can't escape the cache directory
+	for _, name := range []string{"..", ".", "../x", "./this_dir", ""} {
+		_, err := builder.store.CacheDirectory(recipe.Dir(), name)
+		assert.Error(t, err, name)
+	}
+	assert.Error(t, builder.store.CleanCache(".."))
+	assert.DirExists(t, builder.store.OutputPath(recipe.Hash()))
+}
+
+func TestLockCacheDirectories(t *testing.T) {
+	builder, values := parseTestPackage(t, `
+target "tool" {
+  env    = { CACHE_DIR = cache_directory() }
+  script = "echo $CACHE_DIR"
+}
+target "run_tool" {
+  inputs = [tool]
+  script = "$tool"
+}
+`)
+	tool, _ := values["tool"].Recipe()
+	runTool, _ := values["run_tool"].Recipe()
+	cacheDir, err := builder.store.CacheDirectory(tool.Dir(), "tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The cache of a target is locked when anything that can run it is
+	unlock, err := builder.LockCacheDirectories(runTool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(cacheDir + ".lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	locked, err := tryLockFile(f)
+	assert.NoError(t, err)
+	assert.False(t, locked)
+	assert.NoError(t, unlock())
+	locked, err = tryLockFile(f)
+	assert.NoError(t, err)
+	assert.True(t, locked)
+}
+
+func TestBuildDownloadFile(t *testing.T) {
+	body := []byte("#!/bin/sh\necho hi\n")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(body)
+	}))
+	defer server.Close()
+
+	sum := sha256.Sum256(body)
+	builder, values := parseTestPackage(t, `
+hello = download_file("`+server.URL+`/hello.sh", "`+bytesToBase32Hash(sum[:])+`")
+bad   = download_file("`+server.URL+`/bad.sh", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+
+store "hello_store" {
+  script = "test -f ${hello}/hello.sh && echo ok > $out/ok"
+}
+store "bad_store" {
+  script = "echo ${bad}"
+}
+`)
+	path := buildTestRecipe(t, builder, values, "hello_store")
+	assert.FileExists(t, filepath.Join(path, "ok"))
+
+	recipe, _ := values["bad_store"].Recipe()
+	_, err := builder.Build(context.Background(), recipe)
+	assert.Contains(t, err.Error(), "hash mismatch")
+}
+
+func TestExtractTarGzThroughSymlink(t *testing.T) {
+	outside := t.TempDir()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, hdr := range []*tar.Header{
+		{Name: "a", Typeflag: tar.TypeSymlink, Linkname: outside},
+		{Name: "a/x", Typeflag: tar.TypeReg, Mode: 0644, Size: 2},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			_, _ = tw.Write([]byte("x\n"))
+		}
+	}
+	_ = tw.Close()
+	_ = gz.Close()
+
+	err := extractTarGz(&buf, t.TempDir())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "is a symlink")
+	}
+	_, err = os.Stat(filepath.Join(outside, "x"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestBuildTargetReference(t *testing.T) {
+	builder, values := parseTestPackage(t, `
+store "a" {
+  script = "echo a > $out/a"
+}
+target "greet" {
+  inputs = [a]
+  env    = { GREETING = "it's" }
+  script = "test -f $a/a && echo \"$GREETING $1\""
+}
+store "greeting" {
+  inputs = [greet]
+  script = "${greet} 'a greeting' > $out/greeting"
+}
+`)
+	// What a target that failed part way through materializing used to leave
+	// behind is replaced
+	greet := builder.store.OutputPath(values["greet"].recipe.Hash())
+	if err := os.MkdirAll(filepath.Join(greet, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(greet, "script"), []byte("exit 1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	path := buildTestRecipe(t, builder, values, "greeting")
+	b, err := os.ReadFile(filepath.Join(path, "greeting"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "it's a greeting\n", string(b))
+	assert.FileExists(t, filepath.Join(greet, "bin", "greet"))
+	temporary, _ := filepath.Glob(filepath.Join(builder.store.storeDir(), ".tmp-*"))
+	assert.Empty(t, temporary)
+}
+
+func TestBuildEnv(t *testing.T) {
+	builder, values := parseTestPackage(t, `
+store "a" {
+  script = "echo a > $out/a"
+}
+target "hello" {
+  script = "echo hello"
+}
+target "./hello.txt" {
+  script = "echo hello > hello.txt"
+}
+store "env" {
+  inputs = [a, hello]
+  env    = { FOO = "bar" }
+  script = "echo \"$PATH $HOME $FOO $a $out\" > $out/env && hello > $out/hello"
+}
+store "empty" {
+  script = "echo \"[$PATH]\" > $out/env"
+}
+`)
+	path := buildTestRecipe(t, builder, values, "env")
+	b, err := os.ReadFile(filepath.Join(path, "env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only inputs with executables are on the PATH, a target's wrapper is
+	a := builder.store.OutputPath(values["a"].recipe.Hash())
+	hello := filepath.Join(builder.store.OutputPath(values["hello"].recipe.Hash()), "bin")
+	assert.Equal(t, hello+" /homeless bar "+a+" "+path+"\n", string(b))
+	b, _ = os.ReadFile(filepath.Join(path, "hello"))
+	assert.Equal(t, "hello\n", string(b))
+
+	path = buildTestRecipe(t, builder, values, "empty")
+	b, _ = os.ReadFile(filepath.Join(path, "env"))
+	assert.Equal(t, "[]\n", string(b))
+
+	// Targets that can't be environment variables aren't bound
+	file, _ := values["./hello.txt"].Recipe()
+	_, inputs, err := builder.resolveReferences(context.Background(), Recipe{
+		Name: "file", IsStore: true, Inputs: []string{file.ctyString().AsString()},
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, inputs)
+}
+
+func TestBuildOtherSystem(t *testing.T) {
+	builder, values := parseTestPackage(t, `
+store "other" {
+  system = "plan9-386"
+  script = "echo hi"
+}
+`)
+	recipe, _ := values["other"].Recipe()
+	_, err := builder.Build(context.Background(), recipe)
+	assert.Contains(t, err.Error(), `is for system "plan9-386"`)
+}
+
+func TestBuildWritesDerivationAndOutputHash(t *testing.T) {
+	builder, values := parseTestPackage(t, `
+store "a" {
+  script = "echo a > $out/a"
+}
+`)
+	buildTestRecipe(t, builder, values, "a")
+	recipe, _ := values["a"].Recipe()
+	drv, err := builder.store.ReadDerivation(recipe.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, recipe.Hash(), drv.Hash())
+
+	outputHash, err := builder.store.OutputHash(recipe.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := hashOutput(builder.store.OutputPath(recipe.Hash()))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, outputHash)
+}
+
+func TestBuildLocalInputs(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, contents string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(LakeFilename, `
+store "a" {
+  inputs = ["./in.txt"]
+  script = "read line < in.txt && echo $line > $out/a"
+}
+`)
+	writeFile("in.txt", "one\n")
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	parse := func() (*LocalBuilder, Recipe) {
+		ws := NewWorkspace(dir)
+		values, _, diags := ws.ParseDirectory(dir)
+		if diags.HasErrors() {
+			t.Fatal(diags)
+		}
+		recipe, _ := values["a"].Recipe()
+		return NewLocalBuilder(store, ws), recipe
+	}
+	builder, one := parse()
+	if _, err := builder.Build(context.Background(), one); err != nil {
+		t.Fatal(err)
+	}
+
+	// The contents of local files are part of the hash
+	writeFile("in.txt", "two\n")
+	builder, two := parse()
+	assert.NotEqual(t, one.Hash(), two.Hash())
+	path, err := builder.Build(context.Background(), two)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := os.ReadFile(filepath.Join(path, "a"))
+	assert.Equal(t, "two\n", string(b))
+
+	// A file that changes after the package is parsed doesn't match the hash
+	writeFile("in.txt", "three\n")
+	builder, three := parse()
+	writeFile("in.txt", "four\n")
+	_, err = builder.Build(context.Background(), three)
+	assert.Contains(t, fmt.Sprint(err), `input "./in.txt" of "a" has changed since the package was parsed`)
+
+	if err := os.Remove(filepath.Join(dir, "in.txt")); err != nil {
+		t.Fatal(err)
+	}
+	_, _, diags := NewWorkspace(dir).ParseDirectory(dir)
+	assert.Contains(t, fmt.Sprint(diags.Errs()), `"./in.txt" doesn't exist`)
+}
+
+func TestBuildCancel(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	builder, values := parseTestPackage(t, `
+store "slow" {
+  script = "/bin/sleep 10 && /bin/sleep 10"
+}
+`)
+	recipe, _ := values["slow"].Recipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := builder.Build(ctx, recipe)
+	assert.Equal(t, context.Canceled, err)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = builder.Build(ctx, recipe)
+	assert.Equal(t, context.Canceled, errors.Cause(err))
+	assert.True(t, time.Since(start) < 5*time.Second, "the script and its children are killed when the context is done")
+	_, err = os.Stat(builder.store.OutputPath(recipe.Hash()))
+	assert.True(t, os.IsNotExist(err), "the output of a cancelled build is removed")
+	entries, _ := os.ReadDir(tmp)
+	assert.Empty(t, entries, "temporary build directories are removed")
+}
+
+func TestBuildTimeout(t *testing.T) {
+	builder, values := parseTestPackage(t, `
+store "slow" {
+  timeout = "100ms"
+  script  = "/bin/sleep 10"
+}
+store "fast" {
+  timeout = "10s"
+  script  = "echo $$ > $out/pid"
+}
+`)
+	recipe, _ := values["slow"].Recipe()
+	_, err := builder.Build(context.Background(), recipe)
+	assert.Contains(t, err.Error(), `error building "slow": timed out after 100ms`)
+	assert.Contains(t, readLog(t, builder, recipe), "timed out after 100ms")
+
+	// The timeout isn't part of the hash
+	fast, _ := values["fast"].Recipe()
+	withoutTimeout := fast
+	withoutTimeout.Timeout = ""
+	assert.Equal(t, withoutTimeout.Hash(), fast.Hash())
+	buildTestRecipe(t, builder, values, "fast")
+}
+
+func TestBuildKillsLeftoverProcesses(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("needs /proc")
+	}
+	builder, values := parseTestPackage(t, `
+store "daemon" {
+  script = "/bin/sleep 10 > /dev/null 2>&1 & echo $! > $out/pid"
+}
+`)
+	path := buildTestRecipe(t, builder, values, "daemon")
+	b, err := os.ReadFile(filepath.Join(path, "pid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat := filepath.Join("/proc", strings.TrimSpace(string(b)), "stat")
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		// A killed process that hasn't been reaped is a zombie
+		b, err := os.ReadFile(stat)
+		if err != nil || strings.Contains(string(b), ") Z ") {
+			return
+		}
+	}
+	t.Fatal("a process started by the build is still running")
+}
+
+func TestBuildConcurrently(t *testing.T) {
+	counter := filepath.Join(t.TempDir(), "builds")
+	builder, values := parseTestPackage(t, `
+store "slow" {
+  script = "echo built >> `+counter+` && /bin/sleep 0.2 && echo done > $out/done"
+}
+`)
+	recipe, _ := values["slow"].Recipe()
+	// Builders sharing a store stand in for separate processes
+	var log syncBuffer
+	errs := make(chan error)
+	for i := 0; i < 3; i++ {
+		other := NewLocalBuilder(builder.store, builder.workspace)
+		other.Stdout, other.Stderr = &log, &log
+		go func() {
+			path, err := other.Build(context.Background(), recipe)
+			if err == nil {
+				_, err = os.Stat(filepath.Join(path, "done"))
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, <-errs)
+	}
+	b, err := os.ReadFile(counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "built\n", string(b), "the store is only built once")
+	assert.Contains(t, log.String(), `waiting for another process to finish building "slow"`)
+}
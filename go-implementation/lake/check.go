@@ -0,0 +1,244 @@
+package lake
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// CheckPath returns the location that Check leaves a rebuilt output at when it
+// doesn't match the original. The store's other outputs are left next to
+// their own paths in the same way.
+func (b *LocalBuilder) CheckPath(recipe Recipe) string {
+	return b.checkPath(recipe.Hash())
+}
+
+func (b *LocalBuilder) checkPath(hash string) string {
+	return b.store.OutputPath(hash) + ".check"
+}
+
+// Check rebuilds a store that has already been built and compares the output
+// hash of each rebuilt output with the recorded one. Rebuilt outputs that
+// differ are kept at CheckPath and a description of each file that differs is
+// returned, differences is empty if the recipe reproduced. Differences in
+// outputs other than out are prefixed with the output's name. The rebuild is
+// logged at Store.CheckLogPath, the log of the original build is kept.
+//
+// Outputs can contain their own path so the rebuild has to happen at the same
+// location. The original outputs are moved aside while the recipe is rebuilt
+// and put back afterwards.
+func (b *LocalBuilder) Check(ctx context.Context, recipe Recipe) (differences []string, err error) {
+	if !recipe.IsStore {
+		return nil, errors.Errorf("%q is a target, only stores can be checked", recipe.Name)
+	}
+	unlock, err := b.lock(ctx, recipe)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	expected := map[string]string{}
+	for _, output := range recipe.outputs() {
+		info, valid, err := b.store.QueryPath(output.hash)
+		if err != nil {
+			return nil, err
+		}
+		if !valid {
+			return nil, errors.Errorf("%q hasn't been built", recipe.Name)
+		}
+		expected[output.hash] = info.OutputHash
+	}
+
+	for _, output := range recipe.outputs() {
+		if err := os.RemoveAll(b.checkPath(output.hash)); err != nil {
+			return nil, errors.Wrapf(err, "error removing previous check of %q", recipe.Name)
+		}
+	}
+	originals := map[string]string{}
+	defer func() {
+		for hash := range originals {
+			if restoreErr := b.store.RestorePath(hash); restoreErr != nil && err == nil {
+				err = errors.Wrapf(restoreErr, "error restoring the output of %q", recipe.Name)
+			}
+		}
+	}()
+	for _, output := range recipe.outputs() {
+		original, err := b.store.SetAside(output.hash)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error checking %q", recipe.Name)
+		}
+		originals[output.hash] = original
+	}
+
+	b.progress().Planned(1)
+	if err := b.buildOutput(ctx, recipe, b.store.CheckLogPath(recipe.Hash())); err != nil {
+		return nil, err
+	}
+	for _, output := range recipe.outputs() {
+		outPath := b.store.OutputPath(output.hash)
+		checkPath := b.checkPath(output.hash)
+		got, err := hashOutput(outPath)
+		if err == nil {
+			err = os.Rename(outPath, checkPath)
+		}
+		if err != nil {
+			_ = os.RemoveAll(outPath)
+			return nil, err
+		}
+		if got == expected[output.hash] {
+			if err := os.RemoveAll(checkPath); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		outputDifferences, err := diffOutputs(originals[output.hash], checkPath)
+		if err != nil {
+			return nil, err
+		}
+		if len(outputDifferences) == 0 {
+			outputDifferences = []string{fmt.Sprintf("output hash %s differs from %s", got, expected[output.hash])}
+		}
+		for _, difference := range outputDifferences {
+			if output.name != defaultOutput {
+				difference = output.name + ": " + difference
+			}
+			differences = append(differences, difference)
+		}
+	}
+	return differences, nil
+}
+
+// outputEntry is what an archive records about a file
+type outputEntry struct {
+	mode   fs.FileMode
+	target string
+}
+
+func readOutputEntries(dir string) (entries map[string]outputEntry, names []string, err error) {
+	entries = map[string]outputEntry{}
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entry := outputEntry{mode: fi.Mode().Type()}
+		if fi.Mode().IsRegular() {
+			entry.mode |= fi.Mode() & 0111
+		}
+		if entry.mode&fs.ModeSymlink != 0 {
+			if entry.target, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		entries[rel] = entry
+		names = append(names, rel)
+		return nil
+	})
+	return entries, names, err
+}
+
+// diffOutputs describes the differences between the files in two outputs
+func diffOutputs(a, b string) (differences []string, err error) {
+	aEntries, aNames, err := readOutputEntries(a)
+	if err != nil {
+		return nil, err
+	}
+	bEntries, bNames, err := readOutputEntries(b)
+	if err != nil {
+		return nil, err
+	}
+	names := aNames
+	for _, name := range bNames {
+		if _, found := aEntries[name]; !found {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		aEntry, inA := aEntries[name]
+		bEntry, inB := bEntries[name]
+		switch {
+		case !inB:
+			differences = append(differences, fmt.Sprintf("%s: missing from the rebuild", name))
+		case !inA:
+			differences = append(differences, fmt.Sprintf("%s: only in the rebuild", name))
+		case aEntry.mode.Type() != bEntry.mode.Type():
+			differences = append(differences, fmt.Sprintf("%s: file type changed from %s to %s",
+				name, typeName(aEntry.mode), typeName(bEntry.mode)))
+		case aEntry.mode != bEntry.mode:
+			differences = append(differences, fmt.Sprintf("%s: executable bit changed", name))
+		case aEntry.target != bEntry.target:
+			differences = append(differences, fmt.Sprintf("%s: symlink target changed from %q to %q",
+				name, aEntry.target, bEntry.target))
+		case aEntry.mode.IsRegular():
+			difference, err := diffFiles(filepath.Join(a, name), filepath.Join(b, name))
+			if err != nil {
+				return nil, err
+			}
+			if difference != "" {
+				differences = append(differences, name+": "+difference)
+			}
+		}
+	}
+	return differences, nil
+}
+
+func typeName(mode fs.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return "directory"
+	case mode&fs.ModeSymlink != 0:
+		return "symlink"
+	}
+	return "file"
+}
+
+// diffFiles describes the first difference between two files, it returns an
+// empty string if they're the same
+func diffFiles(a, b string) (string, error) {
+	aBytes, err := os.ReadFile(a)
+	if err != nil {
+		return "", err
+	}
+	bBytes, err := os.ReadFile(b)
+	if err != nil {
+		return "", err
+	}
+	if bytes.Equal(aBytes, bBytes) {
+		return "", nil
+	}
+	if bytes.IndexByte(aBytes, 0) != -1 || bytes.IndexByte(bBytes, 0) != -1 {
+		offset := 0
+		for offset < len(aBytes) && offset < len(bBytes) && aBytes[offset] == bBytes[offset] {
+			offset++
+		}
+		return fmt.Sprintf("binary contents differ at byte %d", offset), nil
+	}
+	aScanner := bufio.NewScanner(bytes.NewReader(aBytes))
+	bScanner := bufio.NewScanner(bytes.NewReader(bBytes))
+	for line := 1; ; line++ {
+		aMore, bMore := aScanner.Scan(), bScanner.Scan()
+		if !aMore && !bMore {
+			// Only trailing newlines or lines too long to scan differ
+			return "contents differ", nil
+		}
+		if aMore != bMore || aScanner.Text() != bScanner.Text() {
+			return fmt.Sprintf("contents differ at line %d\n  - %s\n  + %s",
+				line, aScanner.Text(), bScanner.Text()), nil
+		}
+	}
+}
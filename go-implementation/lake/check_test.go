@@ -0,0 +1,105 @@
+package lake
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	counter := filepath.Join(t.TempDir(), "counter")
+	builder, values := parseTestPackage(t, `
+store "reproducible" {
+  script = "echo hi > $out/hi && /bin/mkdir $out/bin && echo $out > $out/bin/self"
+}
+store "unreproducible" {
+  script = <<EOS
+echo same > $out/same
+if [ -e `+counter+` ]; then
+  echo 2 > $out/count
+  /bin/chmod +x $out/same
+  echo new > $out/new
+  echo rebuild
+else
+  echo 1 > $out/count
+  echo first build
+fi
+echo run >> `+counter+`
+EOS
+}
+store "unbuilt" {
+  script = "true"
+}
+`)
+
+	path := buildTestRecipe(t, builder, values, "reproducible")
+	recipe, _ := values["reproducible"].Recipe()
+	differences, err := builder.Check(context.Background(), recipe)
+	assert.NoError(t, err)
+	assert.Empty(t, differences)
+	assert.FileExists(t, filepath.Join(path, "hi"))
+	_, err = os.Stat(builder.CheckPath(recipe))
+	assert.True(t, os.IsNotExist(err), "check output was removed")
+
+	path = buildTestRecipe(t, builder, values, "unreproducible")
+	recipe, _ = values["unreproducible"].Recipe()
+	differences, err = builder.Check(context.Background(), recipe)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"count: contents differ at line 1\n  - 1\n  + 2",
+		"new: only in the rebuild",
+		"same: executable bit changed",
+	}, differences)
+	// The original output is left in place and the rebuild kept for
+	// inspection
+	b, _ := os.ReadFile(filepath.Join(path, "count"))
+	assert.Equal(t, "1\n", string(b))
+	assert.FileExists(t, filepath.Join(builder.CheckPath(recipe), "new"))
+	// The rebuild has its own log
+	assert.Equal(t, "first build\n", readLog(t, builder, recipe))
+	log, err := builder.store.OpenCheckLog(recipe.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	b, _ = io.ReadAll(log)
+	assert.Equal(t, "rebuild\n", string(b))
+
+	recipe, _ = values["unbuilt"].Recipe()
+	_, err = builder.Check(context.Background(), recipe)
+	assert.Contains(t, err.Error(), "hasn't been built")
+}
+
+func TestCheckKilledMidRebuild(t *testing.T) {
+	counter := filepath.Join(t.TempDir(), "counter")
+	builder, values := parseTestPackage(t, `
+store "a" {
+  script = "echo run >> `+counter+` && echo a > $out/a"
+}
+`)
+	path := buildTestRecipe(t, builder, values, "a")
+	recipe, _ := values["a"].Recipe()
+
+	// What a check that was killed while rebuilding leaves behind
+	if _, err := builder.store.SetAside(recipe.Hash()); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	_, valid, err := builder.store.QueryPath(recipe.Hash())
+	assert.NoError(t, err)
+	assert.False(t, valid, "a partial rebuild isn't valid")
+
+	// The original is put back rather than built again
+	assert.Equal(t, path, buildTestRecipe(t, builder, values, "a"))
+	assert.FileExists(t, filepath.Join(path, "a"))
+	_, valid, _ = builder.store.QueryPath(recipe.Hash())
+	assert.True(t, valid)
+	b, _ := os.ReadFile(counter)
+	assert.Equal(t, "run\n", string(b))
+}
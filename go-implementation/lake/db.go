@@ -0,0 +1,202 @@
+package lake
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PathInfo is what the store database records about a valid store output.
+// Outputs are only used once their PathInfo has been registered, an output
+// without one is left over from a build that didn't finish.
+type PathInfo struct {
+	// Hash is the hash of the recipe the output was built from
+	Hash string
+	Name string
+	// Derivation is the location of the recipe's derivation
+	Derivation string
+	// References are the hashes of the other store outputs that the output
+	// contains paths to, sorted
+	References []string `json:",omitempty"`
+	OutputHash string
+	// RegisteredAt is when the output became valid
+	RegisteredAt time.Time
+	// BuildTime is how long the output took to build or substitute
+	BuildTime time.Duration
+	// Substituter is the binary cache the output was downloaded from, it's
+	// empty if the output was built locally
+	Substituter string `json:",omitempty"`
+}
+
+// The store database is a directory with a JSON file for each valid output.
+// Each file is written atomically and only by the process that holds the lock
+// for its hash, so readers don't need to take a lock. An output is never
+// changed in place while it's registered, Check and Build move the entry aside
+// before the output, see SetAside.
+func (s Store) dbDir() string { return filepath.Join(s.root, "db") }
+
+func (s Store) pathInfoPath(hash string) string {
+	return filepath.Join(s.dbDir(), hash+".json")
+}
+
+// RegisterPath records that the output for info.Hash is complete and valid
+func (s Store) RegisterPath(info PathInfo) error {
+	b, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.pathInfoPath(info.Hash), append(b, '\n'), 0644)
+}
+
+// QueryPath returns what's recorded about the output of a store recipe. valid
+// is false if the output hasn't been registered or has since been removed.
+func (s Store) QueryPath(hash string) (info PathInfo, valid bool, err error) {
+	b, err := os.ReadFile(s.pathInfoPath(hash))
+	if os.IsNotExist(err) {
+		return PathInfo{}, false, nil
+	}
+	if err != nil {
+		return PathInfo{}, false, errors.Wrapf(err, "error reading store database entry for %s", hash)
+	}
+	if err := json.Unmarshal(b, &info); err != nil {
+		return PathInfo{}, false, errors.Wrapf(err, "error reading store database entry for %s", hash)
+	}
+	if _, err := os.Lstat(s.OutputPath(hash)); err != nil {
+		return PathInfo{}, false, nil
+	}
+	// An output that was set aside and never restored might have been
+	// replaced, it's only valid again once RecoverPath has put it back
+	if _, err := os.Lstat(s.setAsidePath(hash)); err == nil {
+		return PathInfo{}, false, nil
+	}
+	return info, true, nil
+}
+
+// setAsidePath is where SetAside moves an output to, and setAsideInfoPath is
+// where its database entry is moved to
+func (s Store) setAsidePath(hash string) string {
+	return filepath.Join(s.storeDir(), ".tmp-"+hash+".original")
+}
+
+func (s Store) setAsideInfoPath(hash string) string {
+	return s.pathInfoPath(hash) + ".original"
+}
+
+// SetAside moves a valid output and its database entry out of the way so that
+// the output can be rebuilt at the same path, it returns where the output was
+// moved to. The entry is moved first so that a partial rebuild is never seen
+// as valid. RestorePath puts them back. The path's lock should be held.
+func (s Store) SetAside(hash string) (original string, err error) {
+	if err := os.Rename(s.pathInfoPath(hash), s.setAsideInfoPath(hash)); err != nil {
+		return "", errors.Wrapf(err, "error moving aside the database entry for %s", hash)
+	}
+	original = s.setAsidePath(hash)
+	if err := os.Rename(s.OutputPath(hash), original); err != nil {
+		_ = os.Rename(s.setAsideInfoPath(hash), s.pathInfoPath(hash))
+		return "", errors.Wrapf(err, "error moving aside the output of %s", hash)
+	}
+	return original, nil
+}
+
+// RestorePath replaces whatever is at an output's path with the output that
+// was set aside and then restores its database entry. It does nothing if
+// nothing was set aside, so it's also how an output is recovered when the
+// process that set it aside was killed. The path's lock should be held.
+func (s Store) RestorePath(hash string) error {
+	original := s.setAsidePath(hash)
+	if _, err := os.Lstat(original); err == nil {
+		if err := os.RemoveAll(s.OutputPath(hash)); err != nil {
+			return errors.Wrapf(err, "error removing the rebuild of %s", hash)
+		}
+		if err := os.Rename(original, s.OutputPath(hash)); err != nil {
+			return errors.Wrapf(err, "error restoring the output of %s", hash)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	err := os.Rename(s.setAsideInfoPath(hash), s.pathInfoPath(hash))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "error restoring the database entry for %s", hash)
+	}
+	return nil
+}
+
+// ValidPaths returns every valid output in the store, sorted by hash
+func (s Store) ValidPaths() (infos []PathInfo, err error) {
+	entries, err := os.ReadDir(s.dbDir())
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading store database")
+	}
+	for _, entry := range entries {
+		hash := strings.TrimSuffix(entry.Name(), ".json")
+		if !IsHash(hash) || hash+".json" != entry.Name() {
+			continue
+		}
+		info, valid, err := s.QueryPath(hash)
+		if err != nil {
+			return nil, err
+		}
+		if valid {
+			infos = append(infos, info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Hash < infos[j].Hash })
+	return infos, nil
+}
+
+// InvalidatePath removes the output of a store recipe along with its database
+// entry and output hash. The entry is removed first so the output is never
+// seen as valid while it's being removed. The path's lock should be held.
+func (s Store) InvalidatePath(hash string) error {
+	for _, path := range []string{s.pathInfoPath(hash), s.OutputPath(hash), s.OutputHashPath(hash)} {
+		if err := os.RemoveAll(path); err != nil {
+			return errors.Wrapf(err, "error removing %q", path)
+		}
+	}
+	return nil
+}
+
+// lockPollInterval is how often a lock held by another process is retried
+var lockPollInterval = 50 * time.Millisecond
+
+// LockPath takes the lock for building the output of a recipe, locks are
+// shared by every process using the store. If another process holds the lock
+// waiting is called once and the lock is retried until it's released or ctx
+// is done. The returned function releases the lock.
+func (s Store) LockPath(ctx context.Context, hash string, waiting func()) (unlock func() error, err error) {
+	path := filepath.Join(s.dbDir(), hash+".lock")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error opening lock file %q", path)
+	}
+	for {
+		locked, err := tryLockFile(f)
+		if err != nil {
+			_ = f.Close()
+			return nil, errors.Wrapf(err, "error locking %q", path)
+		}
+		if locked {
+			break
+		}
+		if waiting != nil {
+			waiting()
+			waiting = nil
+		}
+		select {
+		case <-ctx.Done():
+			_ = f.Close()
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+	return func() error {
+		defer f.Close()
+		return unlockFile(f)
+	}, nil
+}
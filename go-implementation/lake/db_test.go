@@ -0,0 +1,117 @@
+package lake
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathInfo(t *testing.T) {
+	builder, values := parseTestPackage(t, `
+store "a" {
+  script = "echo a > $out/a"
+}
+store "b" {
+  inputs = [a]
+  script = "echo $a > $out/b"
+}
+`)
+	store := builder.store
+	a, _ := values["a"].Recipe()
+	b, _ := values["b"].Recipe()
+	_, valid, err := store.QueryPath(b.Hash())
+	assert.NoError(t, err)
+	assert.False(t, valid)
+
+	buildTestRecipe(t, builder, values, "b")
+	info, valid, err := store.QueryPath(b.Hash())
+	assert.NoError(t, err)
+	assert.True(t, valid)
+	assert.Equal(t, "b", info.Name)
+	assert.Equal(t, store.DerivationPath(b.Hash()), info.Derivation)
+	assert.Equal(t, []string{a.Hash()}, info.References)
+	outputHash, _ := store.OutputHash(b.Hash())
+	assert.Equal(t, outputHash, info.OutputHash)
+	assert.WithinDuration(t, time.Now(), info.RegisteredAt, time.Minute)
+	assert.Empty(t, info.Substituter)
+
+	infos, err := store.ValidPaths()
+	assert.NoError(t, err)
+	assert.Len(t, infos, 2)
+
+	// An output that has been removed isn't valid
+	if err := os.RemoveAll(store.OutputPath(a.Hash())); err != nil {
+		t.Fatal(err)
+	}
+	_, valid, _ = store.QueryPath(a.Hash())
+	assert.False(t, valid)
+
+	if err := store.InvalidatePath(b.Hash()); err != nil {
+		t.Fatal(err)
+	}
+	_, valid, _ = store.QueryPath(b.Hash())
+	assert.False(t, valid)
+	_, err = os.Stat(store.OutputHashPath(b.Hash()))
+	assert.True(t, os.IsNotExist(err))
+	infos, _ = store.ValidPaths()
+	assert.Empty(t, infos)
+}
+
+func TestPathInfoIgnoresUnfinishedOutputs(t *testing.T) {
+	builder, values := parseTestPackage(t, `
+store "a" {
+  script = "echo a > $out/a"
+}
+`)
+	a, _ := values["a"].Recipe()
+	// Left behind by a build that was killed
+	outPath := builder.store.OutputPath(a.Hash())
+	if err := os.MkdirAll(outPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(outPath+"/partial", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	buildTestRecipe(t, builder, values, "a")
+	assert.FileExists(t, outPath+"/a")
+	_, err := os.Stat(outPath + "/partial")
+	assert.True(t, os.IsNotExist(err), "leftovers are removed before building")
+}
+
+func TestLockPath(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	unlock, err := store.LockPath(context.Background(), hash, func() { t.Error("the lock isn't held") })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another lock on the same path waits for the first to be released
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	waited := 0
+	_, err = store.LockPath(ctx, hash, func() { waited++ })
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 1, waited)
+
+	locked := make(chan struct{})
+	go func() {
+		unlock, err := store.LockPath(context.Background(), hash, nil)
+		assert.NoError(t, err)
+		close(locked)
+		assert.NoError(t, unlock())
+	}()
+	select {
+	case <-locked:
+		t.Fatal("the lock was taken twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.NoError(t, unlock())
+	<-locked
+}
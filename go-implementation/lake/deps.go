@@ -0,0 +1,188 @@
+package lake
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/maxmcd/dag"
+	"github.com/pkg/errors"
+)
+
+// packageGraph is what's kept of an orderedParser's graph once a package has
+// been parsed, enough to follow references between names and into imports
+type packageGraph struct {
+	graph *dag.AcyclicGraph
+	// files holds the file each name was declared in
+	files map[string]string
+	// importNames maps the name an import is referenced by in each file to
+	// the name it was imported with
+	importNames map[string]map[string]string
+}
+
+func (op *orderedParser) packageGraph() *packageGraph {
+	files := map[string]string{}
+	for name, parse := range op.referencesToParse {
+		switch {
+		case parse.block != nil:
+			files[name] = parse.block.DefRange.Filename
+		case parse.attr != nil:
+			files[name] = parse.attr.Range.Filename
+		case len(parse.configs) > 0:
+			files[name] = parse.configs[0].DefRange.Filename
+		case parse.variable != nil:
+			files[name] = parse.variable.DefRange.Filename
+		case parse.template != nil:
+			files[name] = parse.template.DefRange.Filename
+		case parse.instance != nil:
+			files[name] = parse.instance.DefRange.Filename
+		}
+	}
+	return &packageGraph{graph: op.graph, files: files, importNames: op.importNames}
+}
+
+// Dependency is a name declared in a package. Package is the name the package
+// was imported with, or empty for the package the graph was created for. A
+// Dependency with no Name stands for a whole imported package.
+type Dependency struct {
+	Package string
+	Name    string
+}
+
+func (d Dependency) String() string {
+	switch {
+	case d.Package == "":
+		return d.Name
+	case d.Name == "":
+		return d.Package
+	}
+	return d.Package + ":" + d.Name
+}
+
+// ParseDependency parses the form returned by Dependency.String
+func ParseDependency(s string) Dependency {
+	if pkg, name, found := strings.Cut(s, ":"); found {
+		return Dependency{Package: pkg, Name: name}
+	}
+	return Dependency{Name: s}
+}
+
+// DependencyGraph answers questions about what depends on what in a package
+// and the packages it imports
+type DependencyGraph struct {
+	ws   *Workspace
+	root Package
+}
+
+// DependencyGraph returns the dependency graph of pkg, which must have been
+// parsed by the workspace
+func (ws *Workspace) DependencyGraph(pkg Package) DependencyGraph {
+	return DependencyGraph{ws: ws, root: pkg}
+}
+
+func (g DependencyGraph) packageGraph(name string) *packageGraph {
+	if name == "" {
+		return g.root.graph
+	}
+	return g.ws.packages[name].graph
+}
+
+// Has reports whether d is declared
+func (g DependencyGraph) Has(d Dependency) bool {
+	pg := g.packageGraph(d.Package)
+	if pg == nil {
+		return false
+	}
+	return d.Name == "" || pg.graph.HasVertex(d.Name)
+}
+
+// Dependencies returns everything that d references directly, sorted
+func (g DependencyGraph) Dependencies(d Dependency) (deps []Dependency) {
+	pg := g.packageGraph(d.Package)
+	if pg == nil || d.Name == "" || !pg.graph.HasVertex(d.Name) {
+		return nil
+	}
+	seen := map[Dependency]struct{}{}
+	for _, v := range pg.graph.DownEdges(d.Name).List() {
+		name := v.(string)
+		root, member, hasMember := strings.Cut(name, ".")
+		dep := Dependency{Package: d.Package, Name: name}
+		if importName, found := pg.importNames[pg.files[d.Name]][root]; found {
+			// A reference to an import, or to a name within it
+			dep = Dependency{Package: importName}
+			if hasMember {
+				dep.Name, _, _ = strings.Cut(member, ".")
+			}
+		} else if _, declared := pg.files[name]; !declared && hasMember {
+			// An attribute of a local value
+			dep.Name = root
+		}
+		if _, found := seen[dep]; !found {
+			seen[dep] = struct{}{}
+			deps = append(deps, dep)
+		}
+	}
+	sortDependencies(deps)
+	return deps
+}
+
+// Transitive returns everything that d depends on directly or indirectly,
+// sorted
+func (g DependencyGraph) Transitive(d Dependency) (deps []Dependency) {
+	seen := map[Dependency]struct{}{d: {}}
+	queue := []Dependency{d}
+	for len(queue) > 0 {
+		for _, dep := range g.Dependencies(queue[0]) {
+			if _, found := seen[dep]; !found {
+				seen[dep] = struct{}{}
+				deps = append(deps, dep)
+				queue = append(queue, dep)
+			}
+		}
+		queue = queue[1:]
+	}
+	sortDependencies(deps)
+	return deps
+}
+
+// Path returns a shortest chain of references from one name to another,
+// starting with from and ending with to
+func (g DependencyGraph) Path(from, to Dependency) ([]Dependency, error) {
+	for _, d := range []Dependency{from, to} {
+		if !g.Has(d) {
+			return nil, errors.Errorf("%q isn't declared in the package or its imports", d)
+		}
+	}
+	previous := map[Dependency]Dependency{}
+	seen := map[Dependency]struct{}{from: {}}
+	queue := []Dependency{from}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if current == to {
+			path := []Dependency{to}
+			for current != from {
+				current = previous[current]
+				path = append([]Dependency{current}, path...)
+			}
+			return path, nil
+		}
+		for _, dep := range g.Dependencies(current) {
+			if _, found := seen[dep]; !found {
+				seen[dep] = struct{}{}
+				previous[dep] = current
+				queue = append(queue, dep)
+			}
+		}
+	}
+	return nil, errors.Errorf("%q doesn't depend on %q", from, to)
+}
+
+// sortDependencies puts names in the package before names in imports
+func sortDependencies(deps []Dependency) {
+	sort.Slice(deps, func(i, j int) bool {
+		if deps[i].Package != deps[j].Package {
+			return deps[i].Package < deps[j].Package
+		}
+		return deps[i].Name < deps[j].Name
+	})
+}
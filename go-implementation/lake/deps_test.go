@@ -0,0 +1,55 @@
+package lake
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDependencyGraph(t *testing.T) {
+	ws := NewWorkspace("../..")
+	_, pkg, diags := ws.ParseDirectory("../../lib/nix-seed")
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	graph := ws.DependencyGraph(pkg)
+	busybox := func(name string) Dependency { return Dependency{Package: "lake/lib/busybox", Name: name} }
+
+	// Recipes depend on the config they default to
+	assert.Equal(t, []Dependency{{Name: "_static_patchelf"}, {Name: "config"}},
+		graph.Dependencies(Dependency{Name: "patchelf"}))
+	assert.Equal(t, []Dependency{busybox("shell")}, graph.Dependencies(Dependency{Name: "config"}))
+
+	assert.Equal(t, []Dependency{
+		{Name: "_nix_bootstrap_tar"},
+		{Name: "_static_patchelf"},
+		{Name: "config"},
+		{Name: "patchelf"},
+		busybox("busybox"),
+		busybox("busybox_store"),
+		busybox("busybox_tar"),
+		busybox("shell"),
+	}, graph.Transitive(Dependency{Name: "stdenv"}))
+
+	path, err := graph.Path(Dependency{Name: "stdenv"}, ParseDependency("lake/lib/busybox:busybox_tar"))
+	assert.NoError(t, err)
+	assert.Equal(t, []Dependency{
+		{Name: "stdenv"},
+		{Name: "config"},
+		busybox("shell"),
+		busybox("busybox"),
+		busybox("busybox_tar"),
+	}, path)
+
+	_, err = graph.Path(Dependency{Name: "_static_patchelf"}, Dependency{Name: "stdenv"})
+	assert.Contains(t, err.Error(), `"_static_patchelf" doesn't depend on "stdenv"`)
+	_, err = graph.Path(Dependency{Name: "stdenv"}, busybox("missing"))
+	assert.Contains(t, err.Error(), "isn't declared")
+}
+
+func TestDependencyString(t *testing.T) {
+	for _, s := range []string{"name", "lake/lib/busybox:busybox_tar"} {
+		assert.Equal(t, s, ParseDependency(s).String())
+	}
+	assert.Equal(t, "lake/lib/busybox", Dependency{Package: "lake/lib/busybox"}.String())
+}
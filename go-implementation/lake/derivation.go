@@ -0,0 +1,212 @@
+package lake
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// DerivationVersion is the version of the derivation format. It's part of the
+// canonical form and so part of every hash.
+//
+// Recipe hashes are computed as follows:
+//
+//  1. The recipe is converted to a Derivation. Recipe fields are mapped
+//     explicitly, Go struct field order and json tags play no part.
+//  2. The derivation is encoded canonically, see Derivation.Canonical.
+//  3. The encoding is hashed with sha256 and the first 160 bits are encoded
+//     with lowercase base32, see bytesToBase32Hash.
+//
+// Any change that alters the output of these steps for an existing recipe must
+// increment DerivationVersion. TestLibHashes holds golden hashes for the
+// recipes in lib/ so that changes to hashes are flagged in review.
+const DerivationVersion = 2
+
+// Derivation is the normalized form of a recipe. It describes everything that
+// is needed to build the recipe and nothing else, including the contents of
+// the local files a store uses. The canonical encoding of a
+// derivation is what a recipe's hash is computed from and is what is written
+// to the store before a recipe is built.
+type Derivation struct {
+	Version int
+	Name    string
+	// Store is false for targets
+	Store bool
+	// Builder is the program the script is passed to, it's empty if the
+	// recipe uses the builder's default shell
+	Builder string
+	// Args are the arguments passed to the builder before the script
+	Args   []string
+	Script string
+	// Inputs are the recipe's inputs as they were written
+	Inputs []string
+	// Dependencies are the hashes of every recipe this recipe references,
+	// sorted
+	Dependencies []string
+	Env          map[string]string
+	Network      bool
+	// Outputs are the names of a store's outputs, sorted. It's empty for
+	// stores with only the default output.
+	Outputs []string
+	// Sources are the content hashes of a store's local file inputs by path,
+	// relative to the package directory
+	Sources map[string]string
+	System  string
+}
+
+// Derivation returns the recipe's derivation
+func (recipe Recipe) Derivation() Derivation {
+	drv := Derivation{
+		Version:      DerivationVersion,
+		Name:         recipe.Name,
+		Store:        recipe.IsStore,
+		Script:       recipe.Script,
+		Inputs:       recipe.Inputs,
+		Dependencies: recipe.references(),
+		Env:          recipe.Env,
+		Network:      recipe.Network,
+		Sources:      recipe.sources,
+		System:       recipe.System,
+	}
+	if len(recipe.Outputs) > 0 {
+		drv.Outputs = append([]string{}, recipe.Outputs...)
+		sort.Strings(drv.Outputs)
+	}
+	if len(recipe.Shell) > 0 {
+		drv.Builder = recipe.Shell[0]
+		drv.Args = recipe.Shell[1:]
+	}
+	return drv
+}
+
+// Canonical returns the canonical encoding of the derivation. It is a JSON
+// object with keys in sorted order, no insignificant whitespace and empty
+// lists and maps written as [] and {} so that a missing value and an empty
+// value encode identically.
+func (drv Derivation) Canonical() []byte {
+	var buf bytes.Buffer
+	fields := []struct {
+		key   string
+		value interface{}
+	}{
+		{"args", nonNilStrings(drv.Args)},
+		{"builder", drv.Builder},
+		{"dependencies", nonNilStrings(drv.Dependencies)},
+		{"env", nonNilMap(drv.Env)},
+		{"inputs", nonNilStrings(drv.Inputs)},
+		{"name", drv.Name},
+		{"network", drv.Network},
+		{"outputs", nonNilStrings(drv.Outputs)},
+		{"script", drv.Script},
+		{"sources", nonNilMap(drv.Sources)},
+		{"store", drv.Store},
+		{"system", drv.System},
+		{"version", drv.Version},
+	}
+	buf.WriteByte('{')
+	for i, field := range fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(mustMarshal(field.key))
+		buf.WriteByte(':')
+		buf.Write(mustMarshal(field.value))
+	}
+	buf.WriteByte('}')
+	return buf.Bytes()
+}
+
+// Hash returns the hash of the canonical encoding of the derivation
+func (drv Derivation) Hash() string {
+	sum := sha256.Sum256(drv.Canonical())
+	return bytesToBase32Hash(sum[:])
+}
+
+// Indented returns the canonical encoding with indentation for display
+func (drv Derivation) Indented() []byte {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, drv.Canonical(), "", "  "); err != nil {
+		// Shouldn't happen, we just encoded it
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// ParseDerivation decodes a derivation from its canonical encoding
+func ParseDerivation(b []byte) (drv Derivation, err error) {
+	var raw struct {
+		Args         []string          `json:"args"`
+		Builder      string            `json:"builder"`
+		Dependencies []string          `json:"dependencies"`
+		Env          map[string]string `json:"env"`
+		Inputs       []string          `json:"inputs"`
+		Name         string            `json:"name"`
+		Network      bool              `json:"network"`
+		Outputs      []string          `json:"outputs"`
+		Script       string            `json:"script"`
+		Sources      map[string]string `json:"sources"`
+		Store        bool              `json:"store"`
+		System       string            `json:"system"`
+		Version      int               `json:"version"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return Derivation{}, errors.Wrap(err, "error parsing derivation")
+	}
+	if raw.Version != DerivationVersion {
+		return Derivation{}, errors.Errorf(
+			"unsupported derivation version %d, expected %d", raw.Version, DerivationVersion)
+	}
+	// Both are nil in a recipe's derivation when there are none
+	if len(raw.Outputs) == 0 {
+		raw.Outputs = nil
+	}
+	if len(raw.Sources) == 0 {
+		raw.Sources = nil
+	}
+	return Derivation{
+		Version:      raw.Version,
+		Name:         raw.Name,
+		Store:        raw.Store,
+		Builder:      raw.Builder,
+		Args:         raw.Args,
+		Script:       raw.Script,
+		Inputs:       raw.Inputs,
+		Dependencies: raw.Dependencies,
+		Env:          raw.Env,
+		Network:      raw.Network,
+		Outputs:      raw.Outputs,
+		Sources:      raw.Sources,
+		System:       raw.System,
+	}, nil
+}
+
+// mustMarshal encodes v as JSON without escaping HTML characters, scripts are
+// full of them
+func mustMarshal(v interface{}) []byte {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		// Shouldn't happen, we only encode strings, bools, ints and string
+		// collections
+		panic(err)
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+}
+
+func nonNilStrings(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+func nonNilMap(values map[string]string) map[string]string {
+	if values == nil {
+		return map[string]string{}
+	}
+	return values
+}
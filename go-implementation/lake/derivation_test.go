@@ -0,0 +1,131 @@
+package lake
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDerivationCanonical(t *testing.T) {
+	recipe := Recipe{
+		Name:    "busybox_store",
+		IsStore: true,
+		Inputs:  []string{"{{ 525zavu5llf5gyfyq73x5mys6mrs7vha }}", "./install.sh"},
+		Shell:   []string{"{{ 525zavu5llf5gyfyq73x5mys6mrs7vha }}/busybox-x86_64", "sh"},
+		Script:  "sh ./install.sh > /dev/null && echo <done>",
+		Env:     map[string]string{"b": "2", "a": "1"},
+		System:  "linux-amd64",
+		sources: map[string]string{"./install.sh": "sha256:1b2ffmjyxr5fik4p41jmqqan2ht2rlnp"},
+	}
+	drv := recipe.Derivation()
+	assert.Equal(t, `{"args":["sh"],"builder":"{{ 525zavu5llf5gyfyq73x5mys6mrs7vha }}/busybox-x86_64",`+
+		`"dependencies":["525zavu5llf5gyfyq73x5mys6mrs7vha"],"env":{"a":"1","b":"2"},`+
+		`"inputs":["{{ 525zavu5llf5gyfyq73x5mys6mrs7vha }}","./install.sh"],"name":"busybox_store",`+
+		`"network":false,"outputs":[],"script":"sh ./install.sh > /dev/null && echo <done>",`+
+		`"sources":{"./install.sh":"sha256:1b2ffmjyxr5fik4p41jmqqan2ht2rlnp"},"store":true,`+
+		`"system":"linux-amd64","version":2}`, string(drv.Canonical()))
+	assert.Equal(t, recipe.Hash(), drv.Hash())
+
+	parsed, err := ParseDerivation(drv.Canonical())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, drv, parsed)
+
+	// Missing and empty values are the same recipe
+	empty := Recipe{Name: "empty", Inputs: []string{}, Env: map[string]string{}}
+	assert.Equal(t, Recipe{Name: "empty"}.Hash(), empty.Hash())
+
+	_, err = ParseDerivation([]byte(`{"version":0}`))
+	assert.Contains(t, err.Error(), "unsupported derivation version")
+}
+
+var updateGolden = flag.Bool("update", false, "update golden files")
+
+// TestLibHashes confirms that the hashes of the recipes in lib/ don't change.
+// If this fails and the change is intentional, bump DerivationVersion if the
+// canonical form changed and then run `go test ./lake -run TestLibHashes
+// -update`.
+func TestLibHashes(t *testing.T) {
+	hashes := map[string]string{}
+	for _, pkg := range []string{"busybox", "nix-seed"} {
+		ws := NewWorkspace("../..")
+		// Hashes include the system, evaluate for a fixed one so that the
+		// test passes on any host
+		ws.System = "linux-amd64"
+		values, _, diags := ws.ParseDirectory(filepath.Join("../../lib", pkg))
+		if diags.HasErrors() {
+			t.Fatal(diags)
+		}
+		for name, value := range values {
+			if recipe, found := value.Recipe(); found {
+				hashes[pkg+"/"+name] = recipe.Hash()
+			}
+		}
+	}
+
+	goldenPath := filepath.Join("testdata", "lib_hashes.golden.json")
+	if *updateGolden {
+		b, err := json.MarshalIndent(hashes, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(goldenPath, append(b, '\n'), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := os.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var golden map[string]string
+	if err := json.Unmarshal(b, &golden); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, golden, hashes)
+}
+
+// TestDerivationFields fails when a field is added to Recipe or Derivation so
+// that the author decides whether it takes part in the hash
+func TestDerivationFields(t *testing.T) {
+	// Recipe fields and the derivation field they are hashed as, an empty
+	// string means the field is intentionally left out of the hash
+	recipeFields := map[string]string{
+		"Env":      "Env",
+		"Inputs":   "Inputs",
+		"IsStore":  "Store",
+		"Name":     "Name",
+		"Network":  "Network",
+		"Outputs":  "Outputs",
+		"Override": "",
+		"Script":   "Script",
+		"Shell":    "Builder",
+		"System":   "System",
+		"Timeout":  "",
+	}
+	assert.Equal(t, sortedKeys(recipeFields), exportedFields(Recipe{}))
+
+	var keys map[string]interface{}
+	if err := json.Unmarshal(Derivation{}.Canonical(), &keys); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(exportedFields(Derivation{})), len(keys),
+		"every Derivation field must be part of the canonical encoding")
+}
+
+func exportedFields(v interface{}) (names []string) {
+	typ := reflect.TypeOf(v)
+	for i := 0; i < typ.NumField(); i++ {
+		if typ.Field(i).IsExported() {
+			names = append(names, typ.Field(i).Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,123 @@
+package lake
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// forEachAttributeName is the attribute that creates a recipe for each element
+// of a map or list
+const forEachAttributeName = "for_each"
+
+// eachName is the name for_each blocks refer to the current element by, eg:
+// each.key and each.value
+const eachName = "each"
+
+var forEachSchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{{Name: forEachAttributeName}},
+}
+
+// forEachName is the name of the recipe created for key, eg: go["1.21"]
+func forEachName(name, key string) string {
+	return fmt.Sprintf("%s[%q]", name, key)
+}
+
+// hasForEach reports whether a store or target block has a for_each attribute
+func hasForEach(block *hcl.Block) bool {
+	_, found := block.Body.(*hclsyntax.Body).Attributes[forEachAttributeName]
+	return found
+}
+
+// decodeForEach creates a recipe for each element of a block's for_each value.
+// Each recipe is named name["key"] and is decoded with each.key and each.value
+// set to the element. The block's name is a map of the recipes by key, so
+// they're referenced like name["key"].
+func (wd *walkDecoder) decodeForEach(name string, block *hcl.Block, body hcl.Body, attr *hcl.Attribute) (diags hcl.Diagnostics) {
+	ctx := wd.fileEvalContext(block.DefRange.Filename)
+	context := &block.Body.(*hclsyntax.Body).SrcRange
+	value, diags := attr.Expr.Value(ctx)
+	if diags.HasErrors() {
+		return diags
+	}
+	elements, detail := forEachElements(value)
+	if detail != "" {
+		return append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid for_each value",
+			Detail:   detail,
+			Subject:  rangePointer(attr.Expr.Range()),
+			Context:  context,
+		})
+	}
+
+	keys := make([]string, 0, len(elements))
+	for key := range elements {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	recipes := map[string]cty.Value{}
+	for _, key := range keys {
+		recipeName := forEachName(name, key)
+		if diags := wd.nameStore.addBlock(recipeName, block); diags.HasErrors() {
+			return diags
+		}
+		eachCtx := ctx.NewChild()
+		eachCtx.Variables = map[string]cty.Value{eachName: cty.ObjectVal(map[string]cty.Value{
+			"key":   cty.StringVal(key),
+			"value": elements[key],
+		})}
+		recipe, diags := wd.decodeRecipeBody(recipeName, block, body, eachCtx)
+		if diags.HasErrors() {
+			return diags
+		}
+		recipe.forEach = true
+		wd.values[recipeName] = Value{recipe: &recipe}
+		recipes[key] = recipe.ctyValue()
+	}
+
+	value = cty.EmptyObjectVal
+	if len(recipes) > 0 {
+		value = cty.ObjectVal(recipes)
+	}
+	wd.values[name] = Value{cty: &value}
+	wd.evalContext.Variables[name] = value
+	return nil
+}
+
+// forEachElements returns the elements of a for_each value by key. Maps and
+// objects are used as they are, each element of a list or set of strings is
+// both the key and the value. detail describes why the value is invalid.
+func forEachElements(value cty.Value) (elements map[string]cty.Value, detail string) {
+	if value.IsNull() {
+		return nil, "The for_each value is null, it must be a map or a list of strings."
+	}
+	ty := value.Type()
+	elements = map[string]cty.Value{}
+	switch {
+	case ty.IsMapType(), ty.IsObjectType():
+		for it := value.ElementIterator(); it.Next(); {
+			key, element := it.Element()
+			elements[key.AsString()] = element
+		}
+	case ty.IsListType(), ty.IsSetType(), ty.IsTupleType():
+		for it := value.ElementIterator(); it.Next(); {
+			_, element := it.Element()
+			if element.Type() != cty.String || element.IsNull() {
+				return nil, fmt.Sprintf("A list given to for_each must only contain strings, not a %s.",
+					element.Type().FriendlyName())
+			}
+			key := element.AsString()
+			if _, found := elements[key]; found {
+				return nil, fmt.Sprintf("The key %q is in the list given to for_each more than once.", key)
+			}
+			elements[key] = element
+		}
+	default:
+		return nil, fmt.Sprintf("The for_each value must be a map or a list of strings, not a %s.", ty.FriendlyName())
+	}
+	return elements, ""
+}
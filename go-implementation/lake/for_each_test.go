@@ -0,0 +1,50 @@
+package lake
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForEach(t *testing.T) {
+	builder, values := parseTestPackage(t, `
+store "version" {
+  for_each = {
+    old = "1.20"
+    new = "1.21"
+  }
+  script = "echo ${each.key} ${each.value} > $out/version"
+}
+
+store "latest" {
+  inputs = [version["new"]]
+  script = "read v < ${version["new"]}/version && echo $v > $out/version"
+}
+`)
+	old, found := values[`version["old"]`].Recipe()
+	assert.True(t, found)
+	assert.Equal(t, `version["old"]`, old.Name)
+	assert.Equal(t, "echo old 1.20 > $out/version", old.Script)
+	newer, _ := values[`version["new"]`].Recipe()
+	assert.NotEqual(t, old.Hash(), newer.Hash())
+	assert.Equal(t, newer.Range(), old.Range())
+
+	byKey, ok := values["version"].AsMap()
+	if assert.True(t, ok) {
+		s, _ := byKey["new"].AsString()
+		assert.Equal(t, newer.ctyString().AsString(), s)
+	}
+	// Recipes are only exported through the block's name
+	exported := valueMapToCTYObject(values).Type()
+	assert.True(t, exported.HasAttribute("version"))
+	assert.False(t, exported.HasAttribute(`version["new"]`))
+
+	path := buildTestRecipe(t, builder, values, "latest")
+	b, err := os.ReadFile(filepath.Join(path, "version"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "new 1.21\n", string(b))
+}
@@ -0,0 +1,79 @@
+package lake
+
+import (
+	"github.com/pkg/errors"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/function"
+)
+
+var (
+	DownloadFileFunctionName   = "download_file"
+	CacheDirectoryFunctionName = "cache_directory"
+)
+
+// cacheDirectoryPlaceholder is what cache_directory() returns. The builder
+// replaces it with the cache directory of the recipe being built. It's a
+// constant so that the location of the cache never changes a recipe's hash.
+const cacheDirectoryPlaceholder = "{{ cache_directory }}"
+
+// downloadFileRecipe returns the fetcher store that download_file() generates.
+// It uses the same env convention as hand written fetchers so that the builder
+// doesn't need to know where the recipe came from.
+func downloadFileRecipe(url, hash string) Recipe {
+	env := map[string]string{
+		"fetch_url": "true",
+		"url":       url,
+	}
+	if hash != "" {
+		env["hash"] = hash
+	}
+	return Recipe{
+		Env:       env,
+		IsStore:   true,
+		Name:      DownloadFileFunctionName,
+		Network:   true,
+		generated: true,
+	}
+}
+
+// generatedStoreKey is the key a generated store is stored under in the values
+// returned from a package. The leading underscore keeps it from being exported
+// to importers and the hash keeps distinct calls from colliding.
+func generatedStoreKey(recipe Recipe) string {
+	return "_" + recipe.Name + "_" + recipe.Hash()
+}
+
+// functions returns the builtin functions that are available to Lakefiles.
+// Functions that generate stores register them with the walkDecoder as a side
+// effect of being called.
+func (wd *walkDecoder) functions() map[string]function.Function {
+	return map[string]function.Function{
+		DownloadFileFunctionName: function.New(&function.Spec{
+			Params: []function.Parameter{
+				{Name: "url", Type: cty.String},
+			},
+			VarParam: &function.Parameter{Name: "hash", Type: cty.String},
+			Type:     function.StaticReturnType(cty.String),
+			Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+				if len(args) > 2 {
+					return cty.NilVal, errors.Errorf(
+						"%s takes a url and an optional hash, got %d arguments",
+						DownloadFileFunctionName, len(args))
+				}
+				var hash string
+				if len(args) == 2 {
+					hash = args[1].AsString()
+				}
+				recipe := downloadFileRecipe(args[0].AsString(), hash)
+				wd.pendingStores = append(wd.pendingStores, recipe)
+				return recipe.ctyString(), nil
+			},
+		}),
+		CacheDirectoryFunctionName: function.New(&function.Spec{
+			Type: function.StaticReturnType(cty.String),
+			Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+				return cty.StringVal(cacheDirectoryPlaceholder), nil
+			},
+		}),
+	}
+}
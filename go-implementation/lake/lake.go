@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/hashicorp/hcl/v2"
+	"github.com/pkg/errors"
 )
 
 var (
@@ -19,35 +20,143 @@ var (
 type ImportFunction func(name string) (values map[string]Value, diags hcl.Diagnostics)
 
 func TmpLoadLakeImport(name string) (values map[string]Value, diags hcl.Diagnostics) {
-	var projectRoot string
-	do := func() error {
-		dir, err := os.Getwd()
-		if err != nil {
-			return err
-		}
-		for {
-			if _, err := os.Stat(filepath.Join(dir, "go.mod")); err != nil {
-				if os.IsNotExist(err) {
-					dir = filepath.Join(dir, "..")
-					continue
-				}
-				return err
-			}
-			break
-		}
-		projectRoot = dir
-		return nil
-	}
-	if err := do(); err != nil {
+	projectRoot, err := findProjectRoot()
+	if err != nil {
 		return nil, hcl.Diagnostics{&hcl.Diagnostic{
 			Severity: hcl.DiagError,
 			Summary:  err.Error(),
 		}}
 	}
-	vals, _, diags := ParseDirectory(
-		filepath.Join(
-			projectRoot,
-			strings.TrimPrefix(name, "lake/"),
-		), TmpLoadLakeImport)
+	vals, _, diags := ParseDirectory(importPath(projectRoot, name), TmpLoadLakeImport)
 	return vals, diags
 }
+
+func findProjectRoot() (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err != nil {
+			if !os.IsNotExist(err) {
+				return "", err
+			}
+			if parent := filepath.Dir(dir); parent != dir {
+				dir = parent
+				continue
+			}
+			return "", errors.New("couldn't find a project root above the working directory")
+		}
+		return dir, nil
+	}
+}
+
+func importPath(projectRoot, name string) string {
+	return filepath.Join(projectRoot, strings.TrimPrefix(name, "lake/"))
+}
+
+// Workspace loads packages along with their imports. Each imported package is
+// only parsed once and every recipe that is seen is indexed by its hash so that
+// references to recipes in other packages can be resolved when building.
+type Workspace struct {
+	// System is the system packages are evaluated for, it defaults to the
+	// host system
+	System string
+	// Variables are values for the variables of the packages parsed with
+	// ParseDirectory, they take precedence over LAKE_VAR_<name> environment
+	// variables and defaults. It's an error to set a variable that the package
+	// doesn't declare. Imported packages always use their defaults.
+	Variables map[string]string
+
+	projectRoot string
+	imports     map[string]map[string]Value
+	packages    map[string]Package
+	recipes     map[string]Recipe
+}
+
+// NewWorkspace returns a workspace that resolves imports relative to
+// projectRoot
+func NewWorkspace(projectRoot string) *Workspace {
+	return &Workspace{
+		System:      HostSystem(),
+		projectRoot: projectRoot,
+		imports:     map[string]map[string]Value{},
+		packages:    map[string]Package{},
+		recipes:     map[string]Recipe{},
+	}
+}
+
+// NewWorkspaceFromWorkingDirectory returns a workspace rooted at the project
+// that contains the working directory
+func NewWorkspaceFromWorkingDirectory() (*Workspace, error) {
+	projectRoot, err := findProjectRoot()
+	if err != nil {
+		return nil, err
+	}
+	return NewWorkspace(projectRoot), nil
+}
+
+// ParseDirectory parses the package at path, loading its imports through the
+// workspace
+func (ws *Workspace) ParseDirectory(path string) (values map[string]Value, pkg Package, diags hcl.Diagnostics) {
+	return ws.parseDirectory(path, Package{system: ws.System, variables: ws.Variables, envVariables: true})
+}
+
+func (ws *Workspace) parseDirectory(path string, pkg Package) (values map[string]Value, _ Package, diags hcl.Diagnostics) {
+	values, pkg, diags = parseDirectory(path, pkg, ws.Import)
+	ws.addRecipes(values)
+	return values, pkg, diags
+}
+
+// Import is an ImportFunction that loads packages relative to the project
+// root
+func (ws *Workspace) Import(name string) (values map[string]Value, diags hcl.Diagnostics) {
+	if values, found := ws.imports[name]; found {
+		return values, nil
+	}
+	values, pkg, diags := ws.parseDirectory(importPath(ws.projectRoot, name), Package{system: ws.System})
+	if !diags.HasErrors() {
+		ws.imports[name] = values
+		ws.packages[name] = pkg
+	}
+	return values, diags
+}
+
+// Recipe returns the recipe with the given hash from any package loaded by
+// the workspace
+func (ws *Workspace) Recipe(hash string) (recipe Recipe, found bool) {
+	recipe, found = ws.recipes[hash]
+	return recipe, found
+}
+
+// Dependencies returns the recipes that recipe references, these are built
+// before it is. The recipes are sorted by hash.
+func (ws *Workspace) Dependencies(recipe Recipe) (dependencies []Recipe, err error) {
+	seen := map[string]struct{}{}
+	for _, hash := range recipe.references() {
+		dependency, found := ws.recipes[hash]
+		if !found {
+			return nil, errors.Errorf("%q references unknown recipe %s", recipe.Name, hash)
+		}
+		// A recipe is referenced more than once when more than one of its
+		// outputs is
+		if _, found := seen[dependency.Hash()]; found {
+			continue
+		}
+		seen[dependency.Hash()] = struct{}{}
+		dependencies = append(dependencies, dependency)
+	}
+	return dependencies, nil
+}
+
+// addRecipes adds the recipes in values by hash, stores with outputs are also
+// added by the hash of each output
+func (ws *Workspace) addRecipes(values map[string]Value) {
+	for _, value := range values {
+		if value.isRecipe() {
+			for _, output := range value.recipe.outputs() {
+				ws.recipes[output.hash] = *value.recipe
+			}
+		}
+	}
+}
@@ -0,0 +1,31 @@
+//go:build !unix
+
+package lake
+
+import (
+	"os"
+	"sync"
+)
+
+// Without flock locks are only shared within this process, processes sharing
+// a store can build the same recipe at the same time
+var fileLocks sync.Map
+
+func fileLock(f *os.File) *sync.Mutex {
+	lock, _ := fileLocks.LoadOrStore(f.Name(), &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
+
+func lockFileExclusive(f *os.File) error {
+	fileLock(f).Lock()
+	return nil
+}
+
+func tryLockFile(f *os.File) (locked bool, err error) {
+	return fileLock(f).TryLock(), nil
+}
+
+func unlockFile(f *os.File) error {
+	fileLock(f).Unlock()
+	return nil
+}
@@ -0,0 +1,28 @@
+//go:build unix
+
+package lake
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFileExclusive takes an exclusive flock on f, waiting for other holders
+// to release it
+func lockFileExclusive(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
+
+// tryLockFile takes an exclusive flock on f, locked is false if another
+// holder has it
+func tryLockFile(f *os.File) (locked bool, err error) {
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,123 @@
+package lake
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// LogPath returns the location of the compressed log of the last build of a
+// store recipe
+func (s Store) LogPath(hash string) string {
+	return filepath.Join(s.logDir(), hash+".log.gz")
+}
+
+// CheckLogPath returns the location of the compressed log of the last check
+// of a store recipe, see LocalBuilder.Check. It's kept apart from the log of
+// the build that's being checked.
+func (s Store) CheckLogPath(hash string) string {
+	return filepath.Join(s.logDir(), hash+".check.log.gz")
+}
+
+// OpenLog returns the log of the last build of a store recipe, whether or not
+// the build succeeded
+func (s Store) OpenLog(hash string) (io.ReadCloser, error) {
+	return openLog(s.LogPath(hash), hash)
+}
+
+// OpenCheckLog returns the log of the last check of a store recipe
+func (s Store) OpenCheckLog(hash string) (io.ReadCloser, error) {
+	return openLog(s.CheckLogPath(hash), hash)
+}
+
+func openLog(path, hash string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error opening build log for %s", hash)
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, errors.Wrapf(err, "error reading build log for %s", hash)
+	}
+	return logReader{Reader: gz, f: f}, nil
+}
+
+type logReader struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (r logReader) Close() error {
+	_ = r.Reader.Close()
+	return r.f.Close()
+}
+
+// buildLog captures the combined output of a build. It's compressed as it's
+// written and replaces the previous log at its path when it's closed.
+type buildLog struct {
+	lock sync.Mutex
+	path string
+	f    *os.File
+	gz   *gzip.Writer
+}
+
+func createLog(path string) (*buildLog, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-"+filepath.Base(path))
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating build log")
+	}
+	return &buildLog{path: path, f: f, gz: gzip.NewWriter(f)}, nil
+}
+
+func (l *buildLog) Write(b []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.gz.Write(b)
+}
+
+func (l *buildLog) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	defer os.Remove(l.f.Name())
+	err := l.gz.Close()
+	if closeErr := l.f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(l.f.Name(), l.path)
+	}
+	return errors.Wrap(err, "error writing build log")
+}
+
+// lineWriter splits what's written to it into lines and passes each one,
+// without its newline, to emit
+type lineWriter struct {
+	emit func(line string)
+	buf  []byte
+}
+
+func (lw *lineWriter) Write(b []byte) (int, error) {
+	lw.buf = append(lw.buf, b...)
+	for {
+		i := bytes.IndexByte(lw.buf, '\n')
+		if i == -1 {
+			return len(b), nil
+		}
+		lw.emit(string(lw.buf[:i]))
+		lw.buf = lw.buf[i+1:]
+	}
+}
+
+// Flush emits a final line that wasn't terminated with a newline
+func (lw *lineWriter) Flush() {
+	if len(lw.buf) > 0 {
+		lw.emit(string(lw.buf))
+		lw.buf = nil
+	}
+}
@@ -0,0 +1,64 @@
+package lake
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readLog(t *testing.T, builder *LocalBuilder, recipe Recipe) string {
+	log, err := builder.store.OpenLog(recipe.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	b, err := io.ReadAll(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestBuildLog(t *testing.T) {
+	builder, values := parseTestPackage(t, `
+store "ok" {
+  script = "echo out && echo err >&2"
+}
+store "fails" {
+  script = "echo about to fail && exit 3"
+}
+`)
+	var stdout, stderr bytes.Buffer
+	builder.Stdout, builder.Stderr = &stdout, &stderr
+
+	buildTestRecipe(t, builder, values, "ok")
+	ok, _ := values["ok"].Recipe()
+	// Stdout and stderr are read separately so their order in the log isn't
+	// fixed
+	assert.ElementsMatch(t, []string{"out", "err", ""},
+		strings.Split(readLog(t, builder, ok), "\n"))
+	assert.Equal(t, "ok> out\n", stdout.String())
+	assert.Equal(t, "ok> err\n", stderr.String())
+
+	fails, _ := values["fails"].Recipe()
+	_, err := builder.Build(context.Background(), fails)
+	assert.Error(t, err)
+	assert.Equal(t, "about to fail\nerror: exit status 3\n", readLog(t, builder, fails))
+}
+
+func TestOutputProgress(t *testing.T) {
+	var out bytes.Buffer
+	progress := &outputProgress{stdout: &out, stderr: &out}
+	a := &lineWriter{emit: func(line string) { progress.Output(Recipe{Name: "a"}, line, false) }}
+	b := &lineWriter{emit: func(line string) { progress.Output(Recipe{Name: "b"}, line, true) }}
+	_, _ = a.Write([]byte("one "))
+	_, _ = b.Write([]byte("two\nthree"))
+	_, _ = a.Write([]byte("line\n"))
+	a.Flush()
+	b.Flush()
+	assert.Equal(t, "b> two\na> one line\nb> three\n", out.String())
+}
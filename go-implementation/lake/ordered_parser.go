@@ -2,9 +2,13 @@ package lake
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/gohcl"
@@ -16,9 +20,14 @@ import (
 )
 
 type toParse struct {
-	block   *hcl.Block
-	attr    *hcl.Attribute
-	configs []*hcl.Block
+	block    *hcl.Block
+	attr     *hcl.Attribute
+	configs  []*hcl.Block
+	variable *hcl.Block
+	template *hcl.Block
+	instance *hcl.Block
+	// local is set for attributes declared in a locals block
+	local bool
 }
 
 // orderedParser takes a collection of hcl blocks and attributes, parses them in
@@ -31,7 +40,10 @@ type orderedParser struct {
 
 	imports        map[string]map[string]Value
 	perFileImports map[string]map[string]map[string]Value
-	importFunc     ImportFunction
+	// importNames maps the name an import is referenced by in each file to
+	// the name it was imported with
+	importNames map[string]map[string]string
+	importFunc  ImportFunction
 
 	// the package we're working on
 	pkg Package
@@ -51,6 +63,35 @@ func errDuplicateName(name string, conflictRange hcl.Range, subject, context *hc
 		Context: context,
 	}
 }
+
+var shellIdentifierRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// reservedEnvNames are environment variables the builder sets for every build,
+// stores can't share their names because they are bound as environment
+// variables when used as an input
+var reservedEnvNames = map[string]struct{}{"out": {}, "PATH": {}, "HOME": {}}
+
+// validateStoreName confirms that a store name can be used as an environment
+// variable in build scripts
+func validateStoreName(name string, block *hcl.Block) (diags hcl.Diagnostics) {
+	var detail string
+	if !shellIdentifierRegexp.MatchString(name) {
+		detail = fmt.Sprintf("Store names are bound as environment variables in build scripts, %q must contain only letters, digits and underscores and must not start with a digit.", name)
+	} else if _, found := reservedEnvNames[name]; found {
+		detail = fmt.Sprintf("The name %q is reserved for an environment variable that is set in every build script.", name)
+	}
+	if detail == "" {
+		return nil
+	}
+	return append(diags, &hcl.Diagnostic{
+		Severity: hcl.DiagError,
+		Summary:  "Invalid store name",
+		Detail:   detail,
+		Subject:  rangePointer(block.LabelRanges[0]),
+		Context:  rangePointer(block.DefRange),
+	})
+}
+
 func newOrderedParser(pkg Package, importFunc ImportFunction) *orderedParser {
 	op := &orderedParser{
 		referencesToParse: map[string]toParse{},
@@ -60,6 +101,7 @@ func newOrderedParser(pkg Package, importFunc ImportFunction) *orderedParser {
 		importFunc:        importFunc,
 		imports:           map[string]map[string]Value{},
 		perFileImports:    map[string]map[string]map[string]Value{},
+		importNames:       map[string]map[string]string{},
 	}
 	return op
 }
@@ -67,7 +109,9 @@ func newOrderedParser(pkg Package, importFunc ImportFunction) *orderedParser {
 func (op *orderedParser) loadImport(filename string, iv importVal) (diags hcl.Diagnostics) {
 	if _, found := op.perFileImports[filename]; !found {
 		op.perFileImports[filename] = map[string]map[string]Value{}
+		op.importNames[filename] = map[string]string{}
 	}
+	op.importNames[filename][iv.refName()] = iv.name
 	values, found := op.imports[iv.name]
 	if found {
 		op.perFileImports[filename][iv.refName()] = values
@@ -82,6 +126,17 @@ func (op *orderedParser) loadImport(filename string, iv importVal) (diags hcl.Di
 func (op *orderedParser) reviewBlocks() (diags hcl.Diagnostics) {
 	for _, file := range op.pkg.files {
 		for _, block := range file.blocks {
+			switch block.Type {
+			case VariableBlockTypeName:
+				diags = append(diags, op.reviewVariable(block)...)
+				continue
+			case TemplateBlockTypeName:
+				diags = append(diags, op.reviewTemplate(block)...)
+				continue
+			case InstanceBlockTypeName:
+				diags = append(diags, op.reviewInstance(block)...)
+				continue
+			}
 			spec, found := blockSpecMap[block.Type]
 			if !found {
 				// Blocks should be validated before reaching this function
@@ -97,6 +152,9 @@ func (op *orderedParser) reviewBlocks() (diags hcl.Diagnostics) {
 			} else {
 				// Is "store" or "target"
 				name = block.Labels[0]
+				if block.Type == StoreBlockTypeName {
+					diags = append(diags, validateStoreName(name, block)...)
+				}
 				diags = append(diags, op.nameStore.addBlock(name, block)...)
 				op.referencesToParse[name] = toParse{block: block}
 			}
@@ -105,7 +163,16 @@ func (op *orderedParser) reviewBlocks() (diags hcl.Diagnostics) {
 			// TODO: validate correct attributes are present here, or catch later?
 			// Can this catch someone up if there are variables present in an
 			// unparsed attribute that we don't pick up here?
-			for _, variable := range hcldec.Variables(block.Body, spec) {
+			variables := hcldec.Variables(block.Body, spec)
+			forEach := block.Type != ConfigBlockTypeName && hasForEach(block)
+			if forEach {
+				attr := block.Body.(*hclsyntax.Body).Attributes[forEachAttributeName]
+				variables = append(variables, attr.Expr.Variables()...)
+			}
+			for _, variable := range variables {
+				if forEach && variable.RootName() == eachName {
+					continue
+				}
 				varName := variableName(variable)
 				op.graph.Add(varName)
 				op.graph.Connect(dag.BasicEdge(name, varName))
@@ -115,6 +182,8 @@ func (op *orderedParser) reviewBlocks() (diags hcl.Diagnostics) {
 	return diags
 }
 
+// variableName returns the name a traversal depends on. Indexes like
+// names[0] depend on the whole value being indexed.
 func variableName(v hcl.Traversal) string {
 	var sb strings.Builder
 	for _, part := range v {
@@ -124,7 +193,7 @@ func variableName(v hcl.Traversal) string {
 		case hcl.TraverseAttr:
 			sb.WriteString("." + t.Name)
 		default:
-			panic(v)
+			return sb.String()
 		}
 	}
 	return sb.String()
@@ -137,7 +206,11 @@ func checkForThingsAboveImport(imprt *hcl.Attribute, file File) (diags hcl.Diagn
 		Detail:   fmt.Sprintf("Import statement must be the first attribute defined in a file."),
 	}
 	importLine := imprt.Range.Start.Line
+	attributes := append([]*hcl.Attribute{}, file.locals...)
 	for _, attr := range file.attributes {
+		attributes = append(attributes, attr)
+	}
+	for _, attr := range attributes {
 		if attr.Name == importAttributeName {
 			continue
 		}
@@ -268,19 +341,28 @@ func (op *orderedParser) reviewAttributes() (diags hcl.Diagnostics) {
 				// `import` is a magic attribute that can't be referenced
 				continue
 			}
-			diags = append(diags, op.nameStore.addAttr(name, attr)...)
-			op.graph.Add(name)
-			variables := attr.Expr.Variables()
-			op.referencesToParse[name] = toParse{attr: attr}
-			for _, variable := range variables {
-				op.graph.Add(variable.RootName())
-				op.graph.Connect(dag.BasicEdge(name, variable.RootName()))
-			}
+			diags = append(diags, op.reviewAttribute(name, attr, false)...)
+		}
+		for _, attr := range file.locals {
+			diags = append(diags, op.reviewAttribute(attr.Name, attr, true)...)
 		}
 	}
 	return diags
 }
 
+func (op *orderedParser) reviewAttribute(name string, attr *hcl.Attribute, local bool) (diags hcl.Diagnostics) {
+	if diags = op.nameStore.addAttr(name, attr); diags.HasErrors() {
+		return diags
+	}
+	op.graph.Add(name)
+	op.referencesToParse[name] = toParse{attr: attr, local: local}
+	for _, variable := range attr.Expr.Variables() {
+		op.graph.Add(variable.RootName())
+		op.graph.Connect(dag.BasicEdge(name, variable.RootName()))
+	}
+	return nil
+}
+
 func (op *orderedParser) checkGraphForCycles() (diags hcl.Diagnostics) {
 	// Report errors for cycles
 	for _, cycles := range op.graph.Cycles() {
@@ -312,12 +394,50 @@ func (op *orderedParser) checkGraphForCycles() (diags hcl.Diagnostics) {
 	return diags
 }
 
+// connectMemberReferences connects references to a member of a value, like
+// stdenv.lib, to the value so that the value is decoded first
+func (op *orderedParser) connectMemberReferences() {
+	for _, vtx := range op.graph.Vertices() {
+		name := vtx.(string)
+		for prefix := name; strings.Contains(prefix, "."); {
+			prefix = prefix[:strings.LastIndex(prefix, ".")]
+			if _, found := op.referencesToParse[prefix]; found {
+				op.graph.Connect(dag.BasicEdge(name, prefix))
+				break
+			}
+		}
+	}
+}
+
 func (op *orderedParser) walkGraphAndAssembleDirectory() (values map[string]Value, diags hcl.Diagnostics) {
+	op.connectMemberReferences()
 	if diags := op.checkGraphForCycles(); diags.HasErrors() {
 		return nil, diags
 	}
 
-	return newWalkDecoder(op.perFileImports).walk(op.graph, op.referencesToParse)
+	wd := newWalkDecoder(op.perFileImports, op.pkg.system)
+	wd.dir = op.pkg.dir
+	wd.variables, wd.envVariables = op.pkg.variables, op.pkg.envVariables
+	wd.nameStore = op.nameStore
+	values, diags = wd.walk(op.graph, op.referencesToParse)
+
+	// Generated stores are added to the graph once the walk is complete so that
+	// they show up as dependencies of the recipes and attributes that created
+	// them.
+	names := make([]string, 0, len(wd.generatedStores))
+	for name := range wd.generatedStores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, recipe := range wd.generatedStores[name] {
+			key := generatedStoreKey(recipe)
+			op.graph.Add(key)
+			op.graph.Connect(dag.BasicEdge(name, key))
+			op.generatedStores = append(op.generatedStores, recipe)
+		}
+	}
+	return values, diags
 }
 
 type nameStore struct {
@@ -410,19 +530,55 @@ type walkDecoder struct {
 	values      map[string]Value
 	evalContext *hcl.EvalContext
 	config      config
+	system      string
+	// dir is the directory of the package, see Package
+	dir string
+
+	// pendingStores are stores generated by builtin functions while decoding
+	// the current vertex, generatedStores holds them by the name of the vertex
+	// that generated them once decoding is complete
+	pendingStores   []Recipe
+	generatedStores map[string][]Recipe
+
+	// nameStore holds the names declared in the package, names created while
+	// decoding, like those of for_each recipes, are added to it
+	nameStore *nameStore
+
+	// variables and envVariables are copied from the package, see Package
+	variables    map[string]string
+	envVariables bool
 
 	imports map[string]map[string]map[string]Value
+	// recipes holds the recipes that have been decoded and those of imported
+	// packages by the hash of each of their outputs, see inputNames
+	recipes map[string]Recipe
 }
 
-func newWalkDecoder(imports map[string]map[string]map[string]Value) *walkDecoder {
-	return &walkDecoder{
+func newWalkDecoder(imports map[string]map[string]map[string]Value, system string) *walkDecoder {
+	if system == "" {
+		system = HostSystem()
+	}
+	wd := &walkDecoder{
+		system: system,
 		evalContext: &hcl.EvalContext{
-			Functions: nil,
 			Variables: map[string]cty.Value{},
 		},
-		values:  map[string]Value{},
-		imports: imports,
+		values:          map[string]Value{},
+		imports:         imports,
+		generatedStores: map[string][]Recipe{},
+		recipes:         map[string]Recipe{},
+	}
+	for _, fileImports := range imports {
+		for _, values := range fileImports {
+			for _, value := range values {
+				if value.isRecipe() {
+					wd.indexRecipe(*value.recipe)
+				}
+			}
+		}
 	}
+	wd.evalContext.Functions = wd.functions()
+	return wd
 }
 
 // insertConfigDescendants patches our graph so that things that depend on config
@@ -451,22 +607,11 @@ func insertConfigDescendants(graph *dag.AcyclicGraph, referencesToParse map[stri
 	}
 }
 
-func mermaidGraph(graph *dag.AcyclicGraph) string {
-	sb := strings.Builder{}
-	sb.WriteString("graph TD;\n")
-	for _, edge := range graph.Edges() {
-		fmt.Fprintf(&sb, "    %s --> %s\n", dag.VertexName(edge.Source()), dag.VertexName(edge.Target()))
-	}
-	return sb.String()
-}
-
 func (wd *walkDecoder) walk(graph *dag.AcyclicGraph, referencesToParse map[string]toParse) (
 	values map[string]Value, diags hcl.Diagnostics) {
 	insertConfigDescendants(graph, referencesToParse)
 	var lock sync.Mutex
 
-	fmt.Println(mermaidGraph(graph))
-
 	errs := graph.Walk(func(v dag.Vertex) error {
 		// Force serial for now
 		lock.Lock()
@@ -487,10 +632,23 @@ func (wd *walkDecoder) walk(graph *dag.AcyclicGraph, referencesToParse map[strin
 				return diags
 			}
 		case parse.attr != nil:
-			if diags := wd.decodeAttribute(name, parse.attr); diags.HasErrors() {
+			if diags := wd.decodeAttribute(name, parse.attr, parse.local); diags.HasErrors() {
+				return diags
+			}
+		case parse.variable != nil:
+			if diags := wd.decodeVariable(name, parse.variable); diags.HasErrors() {
+				return diags
+			}
+		case parse.template != nil:
+			if diags := wd.decodeTemplate(name, parse.template); diags.HasErrors() {
+				return diags
+			}
+		case parse.instance != nil:
+			if diags := wd.decodeInstance(name, parse.instance); diags.HasErrors() {
 				return diags
 			}
 		}
+		wd.addPendingStores(name)
 		return nil
 	})
 	for _, err := range errs {
@@ -500,6 +658,16 @@ func (wd *walkDecoder) walk(graph *dag.AcyclicGraph, referencesToParse map[strin
 	return wd.values, diags
 }
 
+// addPendingStores moves stores generated while decoding name into the values
+// map
+func (wd *walkDecoder) addPendingStores(name string) {
+	for _, recipe := range wd.pendingStores {
+		wd.values[generatedStoreKey(recipe)] = ValueFromRecipe(recipe)
+		wd.generatedStores[name] = append(wd.generatedStores[name], recipe)
+	}
+	wd.pendingStores = nil
+}
+
 func (wd *walkDecoder) fileEvalContext(filename string) *hcl.EvalContext {
 	child := wd.evalContext.NewChild()
 	child.Variables = make(map[string]cty.Value)
@@ -524,41 +692,351 @@ func (wd *walkDecoder) decodeConfig(block *hcl.Block) (diags hcl.Diagnostics) {
 			Subject: &block.DefRange,
 			Context: &block.Body.(*hclsyntax.Body).SrcRange,
 		})
-	} else {
+	} else if len(config.Shell) > 0 {
 		wd.config.Shell = config.Shell
 	}
+	// env and inputs from each config block are combined, an env variable can
+	// only be set by one of them
+	for _, key := range sortedKeys(config.Env) {
+		if _, found := wd.config.Env[key]; found {
+			return append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Conflicting config value",
+				Detail:   fmt.Sprintf("The env variable %q is set by more than one config block.", key),
+				Subject:  rangePointer(block.Body.(*hclsyntax.Body).Attributes["env"].Expr.Range()),
+				Context:  &block.Body.(*hclsyntax.Body).SrcRange,
+			})
+		}
+	}
+	wd.config.Env = mergeEnv(wd.config.Env, config.Env)
+	wd.config.Inputs = mergeInputs(wd.config.Inputs, config.Inputs)
 
 	return diags
 }
 
+// mergeEnv returns the variables in defaults and env, env takes precedence.
+// It's nil if both are empty so that recipes without env hash the same.
+func mergeEnv(defaults, env map[string]string) map[string]string {
+	if len(defaults) == 0 {
+		return env
+	}
+	merged := make(map[string]string, len(defaults)+len(env))
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	for k, v := range env {
+		merged[k] = v
+	}
+	return merged
+}
+
+// mergeInputs returns defaults followed by inputs, an input that's listed
+// more than once is only kept the first time
+func mergeInputs(defaults, inputs []string) []string {
+	if len(defaults) == 0 && len(inputs) == 0 {
+		return inputs
+	}
+	merged := make([]string, 0, len(defaults)+len(inputs))
+	seen := map[string]struct{}{}
+	for _, input := range append(append([]string{}, defaults...), inputs...) {
+		if _, found := seen[input]; !found {
+			seen[input] = struct{}{}
+			merged = append(merged, input)
+		}
+	}
+	return merged
+}
+
 func (wd *walkDecoder) decodeRecipe(name string, block *hcl.Block) (diags hcl.Diagnostics) {
-	var recipe Recipe
-	if diags := gohcl.DecodeBody(block.Body, wd.fileEvalContext(block.DefRange.Filename), &recipe); diags.HasErrors() {
+	content, body, diags := block.Body.PartialContent(forEachSchema)
+	if diags.HasErrors() {
+		return diags
+	}
+	if attr, found := content.Attributes[forEachAttributeName]; found {
+		return wd.decodeForEach(name, block, body, attr)
+	}
+	recipe, diags := wd.decodeRecipeBody(name, block, body, wd.fileEvalContext(block.DefRange.Filename))
+	if diags.HasErrors() {
+		return diags
+	}
+	wd.addRecipe(name, recipe)
+	return nil
+}
+
+// decodeRecipeBody decodes the body of a store or target block, body is the
+// block's body without for_each
+func (wd *walkDecoder) decodeRecipeBody(name string, block *hcl.Block, body hcl.Body, ctx *hcl.EvalContext) (recipe Recipe, diags hcl.Diagnostics) {
+	if diags := gohcl.DecodeBody(body, ctx, &recipe); diags.HasErrors() {
+		context := &block.Body.(*hclsyntax.Body).SrcRange
+		diags = explainOutputReferences(diags, hcldec.Variables(body, recipeSpec), ctx, context)
 		for _, diag := range diags {
 			// Add more context to error
-			diag.Context = &block.Body.(*hclsyntax.Body).SrcRange
+			diag.Context = context
+		}
+		return Recipe{}, diags
+	}
+	recipe.defRange = block.DefRange
+	return wd.completeRecipe(name, recipe, block, wd.config)
+}
+
+func (wd *walkDecoder) addRecipe(name string, recipe Recipe) {
+	wd.values[name] = Value{recipe: &recipe}
+	wd.evalContext.Variables[name] = recipe.ctyValue()
+	wd.indexRecipe(recipe)
+}
+
+func (wd *walkDecoder) indexRecipe(recipe Recipe) {
+	for _, output := range recipe.outputs() {
+		wd.recipes[output.hash] = recipe
+	}
+}
+
+// inputNames returns the names of the environment variables the inputs of a
+// recipe are bound to, see inputName
+func (wd *walkDecoder) inputNames(recipe Recipe) map[string]struct{} {
+	names := map[string]struct{}{}
+	for _, input := range recipe.Inputs {
+		match := referenceRegexp.FindStringSubmatch(input)
+		if match == nil || match[0] != input {
+			continue
+		}
+		if dependency, found := wd.recipes[match[1]]; found {
+			if name, bound := inputName(dependency, match[1]); bound {
+				names[name] = struct{}{}
+			}
 		}
-		return diags
 	}
+	return names
+}
 
+// completeRecipe fills in the defaults of a recipe decoded from a store or
+// target block from cfg, the config of the package the block is in. Recipes
+// the config depends on are decoded before it, cfg is empty for them.
+func (wd *walkDecoder) completeRecipe(name string, recipe Recipe, block *hcl.Block, cfg config) (_ Recipe, diags hcl.Diagnostics) {
 	recipe.Name = name
 	if block.Type == StoreBlockTypeName {
 		recipe.IsStore = true
 	}
+	if recipe.Timeout != "" {
+		if diags := validateTimeout(recipe, block); diags.HasErrors() {
+			return Recipe{}, diags
+		}
+	}
 	if len(recipe.Shell) == 0 {
-		recipe.Shell = wd.config.Shell
+		recipe.Shell = cfg.Shell
 	}
-	wd.values[name] = Value{recipe: &recipe}
-	wd.evalContext.Variables[name] = recipe.ctyString()
+	if recipe.Override {
+		recipe.Inputs = mergeInputs(nil, recipe.Inputs)
+	} else {
+		recipe.Env = mergeEnv(cfg.Env, recipe.Env)
+		recipe.Inputs = mergeInputs(cfg.Inputs, recipe.Inputs)
+	}
+	if recipe.IsStore || recipe.Outputs != nil {
+		if diags := validateOutputs(recipe, block, wd.inputNames(recipe)); diags.HasErrors() {
+			return Recipe{}, diags
+		}
+	}
+	if recipe.System == "" {
+		recipe.System = wd.system
+	}
+	recipe.dir = wd.dir
+	if recipe.IsStore {
+		if diags := hashSources(&recipe, block); diags.HasErrors() {
+			return Recipe{}, diags
+		}
+	}
+	return recipe, nil
+}
 
+// hashSources records the content hash of each of a store's local file inputs
+func hashSources(recipe *Recipe, block *hcl.Block) hcl.Diagnostics {
+	invalid := func(detail string) hcl.Diagnostics {
+		body := block.Body.(*hclsyntax.Body)
+		subject := body.SrcRange
+		if attr, found := body.Attributes["inputs"]; found {
+			subject = attr.Expr.Range()
+		}
+		return hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid local input",
+			Detail:   detail,
+			Subject:  &subject,
+			Context:  &body.SrcRange,
+		}}
+	}
+	inputs, err := recipe.localInputs()
+	if err != nil {
+		return invalid(err.Error() + ".")
+	}
+	for _, input := range inputs {
+		hash, err := hashOutput(filepath.Join(recipe.dir, input))
+		if os.IsNotExist(errors.Cause(err)) {
+			return invalid(fmt.Sprintf(
+				"%q doesn't exist, the contents of the files a store uses are part of its hash.", input))
+		}
+		if err != nil {
+			return invalid(err.Error() + ".")
+		}
+		if recipe.sources == nil {
+			recipe.sources = map[string]string{}
+		}
+		recipe.sources[input] = hash
+	}
 	return nil
 }
 
-func (wd *walkDecoder) decodeAttribute(name string, attr *hcl.Attribute) (diags hcl.Diagnostics) {
-	if wd.evalContext.Variables[name], diags = attr.Expr.Value(wd.fileEvalContext(attr.Range.Filename)); diags.HasErrors() {
-		return diags
+func validateTimeout(recipe Recipe, block *hcl.Block) (diags hcl.Diagnostics) {
+	body := block.Body.(*hclsyntax.Body)
+	subject := body.Attributes["timeout"].Expr.Range()
+	if !recipe.IsStore {
+		return diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Timeout on a target",
+			Detail:   "Only stores are built with a timeout, targets run for as long as they're invoked for.",
+			Subject:  &subject,
+			Context:  &body.SrcRange,
+		})
+	}
+	if timeout, err := time.ParseDuration(recipe.Timeout); err != nil || timeout <= 0 {
+		return diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid timeout",
+			Detail:   fmt.Sprintf("%q isn't a positive duration, durations are written like \"90s\" or \"1h30m\".", recipe.Timeout),
+			Subject:  &subject,
+			Context:  &body.SrcRange,
+		})
+	}
+	return nil
+}
+
+// outputNameRegexp matches output names, outputs are bound to environment
+// variables by name
+var outputNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validateOutputs checks the outputs of a store, or its default output if
+// outputs isn't set. Outputs are bound to environment variables in the build
+// along with the inputs, by the names in inputNames, and the env, so an input
+// or env variable can't have the name of an output.
+func validateOutputs(recipe Recipe, block *hcl.Block, inputNames map[string]struct{}) (diags hcl.Diagnostics) {
+	body := block.Body.(*hclsyntax.Body)
+	invalid := func(attribute, summary, detail string) hcl.Diagnostics {
+		subject := body.SrcRange
+		if attr, found := body.Attributes[attribute]; found {
+			subject = attr.Expr.Range()
+		}
+		return diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  summary,
+			Detail:   detail,
+			Subject:  &subject,
+			Context:  &body.SrcRange,
+		})
+	}
+	if !recipe.IsStore {
+		return invalid("outputs", "Outputs on a target",
+			"Only stores have outputs, targets are run rather than built.")
+	}
+	outputs := []string{defaultOutput}
+	if recipe.Outputs != nil {
+		outputs = recipe.Outputs
+		seen := map[string]struct{}{}
+		for _, name := range recipe.Outputs {
+			_, reserved := reservedEnvNames[name]
+			switch {
+			case !outputNameRegexp.MatchString(name):
+				return invalid("outputs", "Invalid output name",
+					fmt.Sprintf("%q can't be used as an output name, outputs are set as environment variables in the build and must be valid variable names.", name))
+			case reserved && name != defaultOutput:
+				return invalid("outputs", "Invalid output name",
+					fmt.Sprintf("%q is set by the builder and can't be used as an output name.", name))
+			}
+			if _, found := seen[name]; found {
+				return invalid("outputs", "Duplicate output", fmt.Sprintf("The output %q is listed more than once.", name))
+			}
+			seen[name] = struct{}{}
+		}
+		if _, found := seen[defaultOutput]; !found {
+			return invalid("outputs", "Missing default output",
+				fmt.Sprintf("Every store has the output %q, it must be in the list of outputs.", defaultOutput))
+		}
+		if len(seen) == 1 {
+			return invalid("outputs", "Only the default output",
+				fmt.Sprintf("A store with only %q has a single output without outputs being set, leave it out so that the store can be referenced by name.", defaultOutput))
+		}
+	}
+	for _, name := range outputs {
+		if _, found := inputNames[name]; found {
+			return invalid("inputs", "Conflicting output name",
+				fmt.Sprintf("An input is bound to $%s, which is where the output %q is set in the build. Rename the output or the store that's used as an input.", name, name))
+		}
+		if _, found := recipe.Env[name]; found {
+			return invalid("env", "Conflicting output name",
+				fmt.Sprintf("The env variable %q would replace the location of the output %q in the build, env variables can't have the name of an output.", name, name))
+		}
+	}
+	return nil
+}
+
+// isOutputsValue reports whether value is a reference to a store with
+// outputs, see Recipe.ctyValue
+func isOutputsValue(value cty.Value) bool {
+	if !value.IsWhollyKnown() || value.IsNull() || !value.Type().IsObjectType() ||
+		!value.Type().HasAttribute(defaultOutput) {
+		return false
+	}
+	for _, element := range value.AsValueMap() {
+		if element.Type() != cty.String || !referenceRegexp.MatchString(element.AsString()) {
+			return false
+		}
+	}
+	return true
+}
+
+// explainOutputReferences adds a diagnostic to diags for each traversal that
+// refers to a store with outputs without picking one of them, when it's
+// within one of the errors. Such references are objects and cause type errors
+// where a string is expected.
+func explainOutputReferences(diags hcl.Diagnostics, traversals []hcl.Traversal, ctx *hcl.EvalContext, context *hcl.Range) hcl.Diagnostics {
+	original := diags
+	within := func(traversal hcl.Traversal) bool {
+		for _, diag := range original {
+			for _, rng := range []*hcl.Range{diag.Subject, diag.Context} {
+				if rng != nil && rng.Overlaps(traversal.SourceRange()) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	for _, traversal := range traversals {
+		value, valueDiags := traversal.TraverseAbs(ctx)
+		if valueDiags.HasErrors() || !isOutputsValue(value) || !within(traversal) {
+			continue
+		}
+		var names []string
+		for name := range value.Type().AttributeTypes() {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		name := variableName(traversal)
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Reference to a store with outputs",
+			Detail: fmt.Sprintf("%s has the outputs %s, refer to one of them, eg: %s.%s.",
+				name, strings.Join(names, ", "), name, defaultOutput),
+			Subject: rangePointer(traversal.SourceRange()),
+			Context: context,
+		})
+	}
+	return diags
+}
+
+func (wd *walkDecoder) decodeAttribute(name string, attr *hcl.Attribute, local bool) (diags hcl.Diagnostics) {
+	ctx := wd.fileEvalContext(attr.Range.Filename)
+	if wd.evalContext.Variables[name], diags = attr.Expr.Value(ctx); diags.HasErrors() {
+		return explainOutputReferences(diags, attr.Expr.Variables(), ctx, rangePointer(attr.Range))
 	}
 	ctyVal := wd.evalContext.Variables[name]
-	wd.values[name] = Value{cty: &ctyVal}
+	wd.values[name] = Value{cty: &ctyVal, local: local}
 	return nil
 }
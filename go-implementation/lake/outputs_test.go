@@ -0,0 +1,174 @@
+package lake
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// outputsTestPackage returns a builder for a package where "app" only uses the
+// lib output of "stdenv". Each time stdenv is built a line is appended to the
+// returned log file.
+func outputsTestPackage(t *testing.T) (*LocalBuilder, map[string]Value, string) {
+	log := filepath.Join(t.TempDir(), "log")
+	builder, values := parseTestPackage(t, `
+store "stdenv" {
+  outputs = ["out", "lib"]
+  script = <<EOT
+    echo stdenv >> `+log+`
+    echo lib > $lib/libc
+    echo $lib > $out/libdir
+  EOT
+}
+
+store "app" {
+  inputs = [stdenv.lib]
+  script = "read v < $stdenv_lib/libc && echo $v ${stdenv.lib} > $out/app"
+}
+`)
+	return builder, values, log
+}
+
+func TestOutputs(t *testing.T) {
+	builder, values, _ := outputsTestPackage(t)
+	stdenv, _ := values["stdenv"].Recipe()
+	outputs := stdenv.outputs()
+	if !assert.Len(t, outputs, 2) {
+		return
+	}
+	out, lib := outputs[0], outputs[1]
+	assert.Equal(t, recipeOutput{name: "out", hash: stdenv.Hash()}, out)
+	assert.Equal(t, "lib", lib.name)
+	assert.NotEqual(t, out.hash, lib.hash)
+	ws := builder.workspace
+	owner, found := ws.Recipe(lib.hash)
+	assert.True(t, found)
+	assert.Equal(t, stdenv.Hash(), owner.Hash())
+
+	path := buildTestRecipe(t, builder, values, "app")
+	libPath := builder.store.OutputPath(lib.hash)
+	b, err := os.ReadFile(filepath.Join(path, "app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "lib "+libPath+"\n", string(b))
+	assert.FileExists(t, filepath.Join(builder.store.OutputPath(out.hash), "libdir"))
+
+	// Each output only references what it contains
+	info, valid, err := builder.store.QueryPath(out.hash)
+	assert.True(t, valid)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{lib.hash}, info.References)
+	info, _, _ = builder.store.QueryPath(lib.hash)
+	assert.Equal(t, "stdenv.lib", info.Name)
+	assert.Empty(t, info.References)
+	app, _ := values["app"].Recipe()
+	info, _, _ = builder.store.QueryPath(app.Hash())
+	assert.Equal(t, []string{lib.hash}, info.References)
+
+	differences, err := builder.Check(context.Background(), stdenv)
+	assert.NoError(t, err)
+	assert.Empty(t, differences)
+	assert.FileExists(t, filepath.Join(libPath, "libc"))
+}
+
+func TestSubstituteOneOutput(t *testing.T) {
+	cache, err := NewBinaryCache("file://" + t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder, values, log := outputsTestPackage(t)
+	secret, public, err := GenerateKey("test-cache-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder.SigningKey = &secret
+	builder.TrustedKeys = []PublicKey{public}
+	buildTestRecipe(t, builder, values, "app")
+	stdenv, _ := values["stdenv"].Recipe()
+	if err := builder.Push(cache, stdenv); err != nil {
+		t.Fatal(err)
+	}
+
+	stdenvOutputs := stdenv.outputs()
+	for _, output := range stdenvOutputs {
+		if err := builder.store.InvalidatePath(output.hash); err != nil {
+			t.Fatal(err)
+		}
+	}
+	removeOutputs(t, builder, values)
+	builder.Substituters = []BinaryCache{cache}
+	buildTestRecipe(t, builder, values, "app")
+	logContents, _ := os.ReadFile(log)
+	assert.Equal(t, "stdenv\n", string(logContents), "stdenv was rebuilt instead of substituted")
+	// Only the output app needs was substituted
+	_, valid, _ := builder.store.QueryPath(stdenvOutputs[1].hash)
+	assert.True(t, valid)
+	_, valid, _ = builder.store.QueryPath(stdenvOutputs[0].hash)
+	assert.False(t, valid)
+
+	// Building stdenv itself fetches the rest
+	buildTestRecipe(t, builder, values, "stdenv")
+	_, valid, _ = builder.store.QueryPath(stdenvOutputs[0].hash)
+	assert.True(t, valid)
+	logContents, _ = os.ReadFile(log)
+	assert.Equal(t, "stdenv\n", string(logContents))
+}
+
+func TestBuildKeepsValidOutputs(t *testing.T) {
+	cache, err := NewBinaryCache("file://" + t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder, values, log := outputsTestPackage(t)
+	secret, public, err := GenerateKey("test-cache-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder.SigningKey = &secret
+	builder.TrustedKeys = []PublicKey{public}
+	buildTestRecipe(t, builder, values, "app")
+	stdenv, _ := values["stdenv"].Recipe()
+	if err := builder.Push(cache, stdenv); err != nil {
+		t.Fatal(err)
+	}
+	stdenvOutputs := stdenv.outputs()
+	out, lib := stdenvOutputs[0], stdenvOutputs[1]
+	for _, output := range stdenvOutputs {
+		if err := builder.store.InvalidatePath(output.hash); err != nil {
+			t.Fatal(err)
+		}
+	}
+	removeOutputs(t, builder, values)
+	builder.Substituters = []BinaryCache{cache}
+	appPath := buildTestRecipe(t, builder, values, "app")
+	libc := filepath.Join(builder.store.OutputPath(lib.hash), "libc")
+	before, err := os.Stat(libc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	libInfo, _, _ := builder.store.QueryPath(lib.hash)
+
+	// Without the cache the rest of stdenv has to be built, lib is left alone
+	builder.Substituters = nil
+	buildTestRecipe(t, builder, values, "stdenv")
+	logContents, _ := os.ReadFile(log)
+	assert.Equal(t, "stdenv\nstdenv\n", string(logContents))
+	after, err := os.Stat(libc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, os.SameFile(before, after), "lib was replaced")
+	info, valid, _ := builder.store.QueryPath(lib.hash)
+	assert.True(t, valid)
+	assert.Equal(t, libInfo, info)
+	info, valid, _ = builder.store.QueryPath(out.hash)
+	assert.True(t, valid)
+	assert.Equal(t, []string{lib.hash}, info.References)
+	assert.FileExists(t, filepath.Join(appPath, "app"))
+	_, valid, _ = builder.store.QueryPath(filepath.Base(appPath))
+	assert.True(t, valid)
+}
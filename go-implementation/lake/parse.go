@@ -9,6 +9,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
 	"strings"
 
 	"github.com/hashicorp/hcl/v2"
@@ -21,9 +24,49 @@ import (
 	"golang.org/x/crypto/ssh/terminal"
 )
 
+// Value is a value declared in a package, either a recipe or the result of
+// evaluating an attribute. Recipes referenced from within other values, like a
+// list of stores, are strings of the form "{{ hash }}", the recipe can be
+// looked up with Workspace.Recipe.
 type Value struct {
 	cty    *cty.Value
 	recipe *Recipe
+	// local values are declared in a locals block and can't be imported
+	local bool
+}
+
+// Kind is the type of a Value
+type Kind int
+
+const (
+	NullKind Kind = iota
+	StringKind
+	NumberKind
+	BoolKind
+	ListKind
+	MapKind
+	RecipeKind
+	TemplateKind
+)
+
+func (k Kind) String() string {
+	switch k {
+	case StringKind:
+		return "string"
+	case NumberKind:
+		return "number"
+	case BoolKind:
+		return "bool"
+	case ListKind:
+		return "list"
+	case MapKind:
+		return "map"
+	case RecipeKind:
+		return "recipe"
+	case TemplateKind:
+		return "template"
+	}
+	return "null"
 }
 
 func ValueFromCTY(v cty.Value) Value {
@@ -34,17 +77,109 @@ func ValueFromRecipe(r Recipe) Value {
 	return Value{recipe: &r}
 }
 
+// Recipe returns the recipe the value holds, if it holds one
+func (v Value) Recipe() (recipe Recipe, found bool) {
+	if v.recipe == nil {
+		return Recipe{}, false
+	}
+	return *v.recipe, true
+}
+
 func (v Value) isRecipe() bool { return v.recipe != nil }
 func (v Value) isCty() bool    { return v.cty != nil }
 
+// Kind returns the type of the value. Lists, tuples and sets are lists, maps
+// and objects are maps.
+func (v Value) Kind() Kind {
+	switch {
+	case v.isRecipe():
+		return RecipeKind
+	case !v.isCty() || v.cty.IsNull() || !v.cty.IsKnown():
+		return NullKind
+	}
+	switch ty := v.cty.Type(); {
+	case ty == cty.String:
+		return StringKind
+	case ty == cty.Number:
+		return NumberKind
+	case ty == cty.Bool:
+		return BoolKind
+	case ty.IsListType(), ty.IsTupleType(), ty.IsSetType():
+		return ListKind
+	case ty.IsMapType(), ty.IsObjectType():
+		return MapKind
+	case ty.Equals(templateType):
+		return TemplateKind
+	}
+	return NullKind
+}
+
+// AsString returns the value if it's a string
+func (v Value) AsString() (s string, ok bool) {
+	if v.Kind() != StringKind {
+		return "", false
+	}
+	return v.cty.AsString(), true
+}
+
+// AsNumber returns the value if it's a number, converted to a float64
+func (v Value) AsNumber() (n float64, ok bool) {
+	if v.Kind() != NumberKind {
+		return 0, false
+	}
+	n, _ = v.cty.AsBigFloat().Float64()
+	return n, true
+}
+
+// AsBool returns the value if it's a bool
+func (v Value) AsBool() (b bool, ok bool) {
+	if v.Kind() != BoolKind {
+		return false, false
+	}
+	return v.cty.True(), true
+}
+
+// AsList returns the elements of the value if it's a list
+func (v Value) AsList() (values []Value, ok bool) {
+	if v.Kind() != ListKind {
+		return nil, false
+	}
+	for it := v.cty.ElementIterator(); it.Next(); {
+		_, element := it.Element()
+		values = append(values, ValueFromCTY(element))
+	}
+	return values, true
+}
+
+// AsMap returns the entries of the value if it's a map
+func (v Value) AsMap() (values map[string]Value, ok bool) {
+	if v.Kind() != MapKind {
+		return nil, false
+	}
+	values = map[string]Value{}
+	for it := v.cty.ElementIterator(); it.Next(); {
+		key, element := it.Element()
+		values[key.AsString()] = ValueFromCTY(element)
+	}
+	return values, true
+}
+
 func (v Value) toCtyValue() cty.Value {
 	if v.isCty() {
 		return *v.cty
 	}
-	return v.recipe.ctyString()
+	return v.recipe.ctyValue()
 }
 
 func (v Value) MarshalJSON() ([]byte, error) {
+	if v.Kind() == TemplateKind {
+		tmpl := v.cty.EncapsulatedValue().(*recipeTemplate)
+		return json.Marshal(map[string]interface{}{
+			"Template": tmpl.name,
+			"Type":     tmpl.block.Type,
+			"Params":   tmpl.params,
+		})
+	}
 	if v.isCty() {
 		return json.Marshal(ctyjson.SimpleJSONValue{Value: *v.cty})
 	}
@@ -56,7 +191,8 @@ func (v Value) MarshalJSON() ([]byte, error) {
 func valueMapToCTYObject(values map[string]Value) cty.Value {
 	attrTypes := map[string]cty.Value{}
 	for name, value := range values {
-		if strings.HasPrefix(name, "./") || strings.HasPrefix(name, "_") {
+		if strings.HasPrefix(name, "./") || strings.HasPrefix(name, "_") || value.local ||
+			(value.isRecipe() && value.recipe.forEach) {
 			continue
 		}
 		attrTypes[name] = value.toCtyValue()
@@ -64,18 +200,88 @@ func valueMapToCTYObject(values map[string]Value) cty.Value {
 	return cty.ObjectVal(attrTypes)
 }
 
+// config holds defaults for the recipes in a package. Env is merged with
+// each recipe's env and Inputs come before each recipe's inputs, unless the
+// recipe sets override.
 type config struct {
-	Shell []string `hcl:"shell,optional"`
+	Env    map[string]string `hcl:"env,optional"`
+	Inputs []string          `hcl:"inputs,optional"`
+	Shell  []string          `hcl:"shell,optional"`
+}
+
+// variable is the header of a variable block, its body is decoded by
+// decodeVariable
+type variable struct {
+	Name string   `hcl:"name,label"`
+	Body hcl.Body `hcl:",remain"`
+}
+
+// template and instance are the headers of template and instance blocks,
+// their bodies are decoded by decodeTemplate and decodeInstance
+type template struct {
+	Name string   `hcl:"name,label"`
+	Body hcl.Body `hcl:",remain"`
+}
+
+type instance struct {
+	Name string   `hcl:"name,label"`
+	Body hcl.Body `hcl:",remain"`
+}
+
+// locals is a block of attributes that can only be referenced within the
+// package
+type locals struct {
+	Body hcl.Body `hcl:",remain"`
 }
 
 type Recipe struct {
 	Env     map[string]string `hcl:"env,optional" json:",omitempty"`
 	Inputs  []string          `hcl:"inputs,optional" json:",omitempty"`
 	IsStore bool
-	Name    string   `hcl:"name,label"`
-	Network bool     `hcl:"network,optional" json:",omitempty"`
-	Script  string   `hcl:"script,optional" json:",omitempty"`
-	Shell   []string `hcl:"shell,optional" json:",omitempty"`
+	Name    string `hcl:"name,label"`
+	Network bool   `hcl:"network,optional" json:",omitempty"`
+	// Outputs are the names of a store's outputs, each is built to its own
+	// path. A store without outputs has a single output, out.
+	Outputs []string `hcl:"outputs,optional" json:",omitempty"`
+	// Override stops the config's env and inputs from being merged into the
+	// recipe's. The merged values are hashed so it isn't part of the hash.
+	Override bool     `hcl:"override,optional" json:",omitempty"`
+	Script   string   `hcl:"script,optional" json:",omitempty"`
+	Shell    []string `hcl:"shell,optional" json:",omitempty"`
+	System   string   `hcl:"system,optional" json:",omitempty"`
+	// Timeout limits how long a store can take to build, eg: "10m". It
+	// doesn't change what a store builds so it isn't part of the hash.
+	Timeout string `hcl:"timeout,optional" json:",omitempty"`
+
+	// dir is the directory of the package the recipe was defined in, local
+	// file inputs are relative to it
+	dir string
+	// sources holds the content hash of each local file input of a store,
+	// after glob patterns are expanded, so that changing a file changes the
+	// store's hash
+	sources map[string]string
+	// generated is true for stores created by builtin functions
+	generated bool
+	// forEach is true for recipes created by a block with for_each, they're
+	// named name["key"] and are referenced through the block's name
+	forEach bool
+	// defRange is the location of the block the recipe was declared with
+	defRange hcl.Range
+}
+
+// Dir returns the directory of the package the recipe was declared in, it's
+// empty if the recipe wasn't parsed from a directory
+func (recipe Recipe) Dir() string { return recipe.dir }
+
+// Range returns the location of the block the recipe was declared with. The
+// filename is absolute when the recipe was parsed from a directory. Recipes
+// generated by functions like download_file() have no range.
+func (recipe Recipe) Range() hcl.Range {
+	rng := recipe.defRange
+	if recipe.dir != "" && rng.Filename != "" {
+		rng.Filename = filepath.Join(recipe.dir, rng.Filename)
+	}
+	return rng
 }
 
 func (recipe Recipe) JSON() string {
@@ -87,13 +293,9 @@ func (recipe Recipe) JSON() string {
 	return string(b)
 }
 
+// Hash returns the hash of the recipe's derivation
 func (recipe Recipe) Hash() string {
-	h := sha256.New()
-	if err := json.NewEncoder(h).Encode(recipe); err != nil {
-		// Shouldn't happen
-		panic(err)
-	}
-	return bytesToBase32Hash(h.Sum(nil))
+	return recipe.Derivation().Hash()
 }
 
 // bytesToBase32Hash copies nix here
@@ -107,16 +309,122 @@ func bytesToBase32Hash(b []byte) string {
 }
 
 func (recipe Recipe) ctyString() cty.Value {
-	return cty.StringVal(fmt.Sprintf("{{ %s }}", recipe.Hash()))
+	return cty.StringVal(referenceString(recipe.Hash()))
+}
+
+// ctyValue is how a recipe is referenced from other values. A store with
+// outputs is an object with a reference to each output, eg: ${stdenv.lib}.
+func (recipe Recipe) ctyValue() cty.Value {
+	if len(recipe.Outputs) == 0 {
+		return recipe.ctyString()
+	}
+	outputs := map[string]cty.Value{}
+	for _, output := range recipe.outputs() {
+		outputs[output.name] = cty.StringVal(referenceString(output.hash))
+	}
+	return cty.ObjectVal(outputs)
+}
+
+// defaultOutput is the output of a store without outputs, it's the output
+// that's at the path of the recipe's hash
+const defaultOutput = "out"
+
+// recipeOutput is one of a store's outputs. hash is the hash of the output's
+// path in the store, it's the recipe's hash for the default output and is
+// derived from the recipe's hash and the output's name for the others.
+type recipeOutput struct {
+	name string
+	hash string
+}
+
+// outputs returns each of a store's outputs, the default output is first
+func (recipe Recipe) outputs() []recipeOutput {
+	hash := recipe.Hash()
+	outputs := []recipeOutput{{name: defaultOutput, hash: hash}}
+	for _, name := range recipe.Outputs {
+		if name != defaultOutput {
+			sum := sha256.Sum256([]byte(hash + "-" + name))
+			outputs = append(outputs, recipeOutput{name: name, hash: bytesToBase32Hash(sum[:])})
+		}
+	}
+	return outputs
+}
+
+func referenceString(hash string) string {
+	return fmt.Sprintf("{{ %s }}", hash)
+}
+
+var referenceRegexp = regexp.MustCompile(`{{ ([a-z2-7]{32}) }}`)
+
+var hashRegexp = regexp.MustCompile(`^[a-z2-7]{32}$`)
+
+// IsHash reports whether s has the form of a recipe hash
+func IsHash(s string) bool { return hashRegexp.MatchString(s) }
+
+// strings returns every string value in the recipe, these are the values that
+// can contain references to other recipes
+func (recipe Recipe) strings() (values []string) {
+	values = append(values, recipe.Script)
+	values = append(values, recipe.Inputs...)
+	values = append(values, recipe.Shell...)
+	for _, v := range recipe.Env {
+		values = append(values, v)
+	}
+	return values
+}
+
+// references returns the hashes of every recipe referenced by this recipe
+func (recipe Recipe) references() (hashes []string) {
+	seen := map[string]struct{}{}
+	for _, value := range recipe.strings() {
+		for _, match := range referenceRegexp.FindAllStringSubmatch(value, -1) {
+			if _, found := seen[match[1]]; found {
+				continue
+			}
+			seen[match[1]] = struct{}{}
+			hashes = append(hashes, match[1])
+		}
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+// replace returns a copy of the recipe with replacer applied to every string
+// value
+func (recipe Recipe) replace(replacer *strings.Replacer) Recipe {
+	out := recipe
+	out.Script = replacer.Replace(recipe.Script)
+	out.Inputs = replaceAll(replacer, recipe.Inputs)
+	out.Shell = replaceAll(replacer, recipe.Shell)
+	if recipe.Env != nil {
+		out.Env = map[string]string{}
+		for k, v := range recipe.Env {
+			out.Env[k] = replacer.Replace(v)
+		}
+	}
+	return out
+}
+
+func replaceAll(replacer *strings.Replacer, values []string) (out []string) {
+	for _, value := range values {
+		out = append(out, replacer.Replace(value))
+	}
+	return out
 }
 
 var (
-	ConfigBlockTypeName = "config"
-	StoreBlockTypeName  = "store"
-	TargetBlockTypeName = "target"
+	ConfigBlockTypeName   = "config"
+	StoreBlockTypeName    = "store"
+	TargetBlockTypeName   = "target"
+	VariableBlockTypeName = "variable"
+	LocalsBlockTypeName   = "locals"
+	TemplateBlockTypeName = "template"
+	InstanceBlockTypeName = "instance"
 )
 
 var configSpec = &hcldec.TupleSpec{
+	&hcldec.AttrSpec{Name: "env", Type: cty.Map(cty.String), Required: false},
+	&hcldec.AttrSpec{Name: "inputs", Type: cty.List(cty.String), Required: false},
 	&hcldec.AttrSpec{Name: "shell", Type: cty.List(cty.String), Required: false},
 }
 
@@ -124,8 +432,12 @@ var recipeSpec = &hcldec.TupleSpec{
 	&hcldec.AttrSpec{Name: "env", Type: cty.Map(cty.String), Required: false},
 	&hcldec.AttrSpec{Name: "inputs", Type: cty.List(cty.String), Required: false},
 	&hcldec.AttrSpec{Name: "network", Type: cty.Bool, Required: false},
+	&hcldec.AttrSpec{Name: "outputs", Type: cty.List(cty.String), Required: false},
+	&hcldec.AttrSpec{Name: "override", Type: cty.Bool, Required: false},
 	&hcldec.AttrSpec{Name: "script", Type: cty.String, Required: false},
 	&hcldec.AttrSpec{Name: "shell", Type: cty.List(cty.String), Required: false},
+	&hcldec.AttrSpec{Name: "system", Type: cty.String, Required: false},
+	&hcldec.AttrSpec{Name: "timeout", Type: cty.String, Required: false},
 }
 
 var importSpec = &hcldec.TupleSpec{}
@@ -153,10 +465,36 @@ type File struct {
 	file       *hcl.File
 	blocks     hcl.Blocks
 	attributes hcl.Attributes
+	// locals are the attributes of every locals block in the file, in order
+	locals []*hcl.Attribute
 }
 
 type Package struct {
 	files []File
+
+	// dir is the absolute path of the package's directory, local file inputs
+	// are relative to it. It's empty if the package wasn't parsed from a
+	// directory.
+	dir string
+
+	// system is the platform recipes are evaluated for when they don't set
+	// one, the host system is used if it's empty
+	system string
+
+	// variables are values for the package's variables that take precedence
+	// over LAKE_VAR_<name> environment variables and defaults
+	variables map[string]string
+	// envVariables is true if variables can be set from the environment
+	envVariables bool
+
+	// graph is set once the package has been parsed
+	graph *packageGraph
+}
+
+// HostSystem returns the system that recipes default to, made up of the host
+// GOOS and GOARCH, eg: "linux-amd64"
+func HostSystem() string {
+	return runtime.GOOS + "-" + runtime.GOARCH
 }
 
 func (pkg Package) FileMap() map[string]*hcl.File {
@@ -175,25 +513,48 @@ func parseHCL(src []byte, filename string) (file File, diags hcl.Diagnostics) {
 	content, attrBody, diags := parseHCLBody(hclFile.Body)
 	attributes, theseDiags := attrBody.JustAttributes()
 	diags = append(diags, theseDiags...)
-	return File{
+	file = File{
 		filename:   filename,
 		file:       hclFile,
-		blocks:     content.Blocks,
 		attributes: attributes,
-	}, diags
+	}
+	for _, block := range content.Blocks {
+		if block.Type != LocalsBlockTypeName {
+			file.blocks = append(file.blocks, block)
+			continue
+		}
+		attributes, theseDiags := block.Body.JustAttributes()
+		diags = append(diags, theseDiags...)
+		// Duplicates are reported by the nameStore along with every other name
+		for _, attr := range attributes {
+			file.locals = append(file.locals, attr)
+		}
+	}
+	sort.Slice(file.locals, func(i, j int) bool {
+		return file.locals[i].Range.Start.Byte < file.locals[j].Range.Start.Byte
+	})
+	return file, diags
 }
 
 func rangePointer(r hcl.Range) *hcl.Range { return &r }
 
 func parseHCLBody(body hcl.Body) (content *hcl.BodyContent, attrBody hcl.Body, diags hcl.Diagnostics) {
 	schema, _ := gohcl.ImpliedBodySchema(struct {
-		Configs []config `hcl:"config,block"`
-		Stores  []Recipe `hcl:"store,block"`
-		Targets []Recipe `hcl:"target,block"`
+		Configs   []config   `hcl:"config,block"`
+		Stores    []Recipe   `hcl:"store,block"`
+		Targets   []Recipe   `hcl:"target,block"`
+		Variables []variable `hcl:"variable,block"`
+		Locals    []locals   `hcl:"locals,block"`
+		Templates []template `hcl:"template,block"`
+		Instances []instance `hcl:"instance,block"`
 	}{})
 	content, attrBody, diags = body.PartialContent(schema)
+	blockTypes := map[string]struct{}{}
+	for _, header := range schema.Blocks {
+		blockTypes[header.Type] = struct{}{}
+	}
 	for _, block := range attrBody.(*hclsyntax.Body).Blocks {
-		if _, found := blockSpecMap[block.Type]; !found {
+		if _, found := blockTypes[block.Type]; !found {
 			diags = diags.Append(&hcl.Diagnostic{
 				Severity: hcl.DiagError,
 				Summary:  fmt.Sprintf("Found unexpected block type %q", block.Type),
@@ -209,27 +570,48 @@ func parseHCLBody(body hcl.Body) (content *hcl.BodyContent, attrBody hcl.Body, d
 }
 
 func parseBody(pkg Package, importFunc ImportFunction) (values map[string]Value, diags hcl.Diagnostics) {
+	values, _, diags = parseBodyWithGraph(pkg, importFunc)
+	return values, diags
+}
+
+// parseBodyWithGraph is parseBody that also returns the dependency graph of
+// the package
+func parseBodyWithGraph(pkg Package, importFunc ImportFunction) (values map[string]Value, graph *packageGraph, diags hcl.Diagnostics) {
 	dirParser := newOrderedParser(pkg, importFunc)
 
 	diags = append(diags, dirParser.loadImports()...)
 	if diags.HasErrors() {
 		// Import errors will likely cause a variety of irrelevant downstream
 		// errors
-		return nil, diags
+		return nil, nil, diags
 	}
 	diags = append(diags, dirParser.reviewBlocks()...)
 	diags = append(diags, dirParser.reviewAttributes()...)
+	diags = append(diags, dirParser.checkVariableOverrides()...)
 
 	if diags.HasErrors() {
-		return nil, diags
+		return nil, nil, diags
 	}
 
-	return dirParser.walkGraphAndAssembleDirectory()
+	values, diags = dirParser.walkGraphAndAssembleDirectory()
+	return values, dirParser.packageGraph(), diags
 }
 
 // ParseDirectory takes a directory and searches it for Lakefiles. Those files
-// are parsed and the resulting data is returned.
+// are parsed for the host system and the resulting data is returned.
 func ParseDirectory(path string, importFunc ImportFunction) (values map[string]Value, pkg Package, diags hcl.Diagnostics) {
+	return ParseDirectoryForSystem(path, HostSystem(), importFunc)
+}
+
+// ParseDirectoryForSystem is ParseDirectory for recipes that target system
+// instead of the host
+func ParseDirectoryForSystem(path, system string, importFunc ImportFunction) (values map[string]Value, pkg Package, diags hcl.Diagnostics) {
+	return parseDirectory(path, Package{system: system}, importFunc)
+}
+
+// parseDirectory parses the Lakefiles in path into pkg, which holds the
+// options the package is parsed with
+func parseDirectory(path string, pkg Package, importFunc ImportFunction) (values map[string]Value, _ Package, diags hcl.Diagnostics) {
 	entries, err := os.ReadDir(path)
 	if err != nil {
 		return nil, Package{}, diags.Append(&hcl.Diagnostic{
@@ -257,8 +639,14 @@ func ParseDirectory(path string, importFunc ImportFunction) (values map[string]V
 	if diags.HasErrors() {
 		return nil, pkg, diags
 	}
+	if pkg.dir, err = filepath.Abs(path); err != nil {
+		return nil, pkg, diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  errors.Wrapf(err, "error attempting to read directory %q", path).Error(),
+		})
+	}
 
-	values, diags = parseBody(pkg, importFunc)
+	values, pkg.graph, diags = parseBodyWithGraph(pkg, importFunc)
 	return values, pkg, diags
 }
 
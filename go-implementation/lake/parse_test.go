@@ -1,8 +1,11 @@
 package lake
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/gohcl"
 	"github.com/hashicorp/hcl/v2/hcldec"
 	"github.com/stretchr/testify/assert"
@@ -31,3 +34,279 @@ func TestConfirmSchemaMatch(t *testing.T) {
 		assert.Equal(t, schema, hcldec.ImpliedSchema(configSpec))
 	}
 }
+
+func TestDownloadFile(t *testing.T) {
+	file, diags := parseHCL([]byte(`
+busybox_tar = download_file("http://lake.com/busybox.tar.gz")
+also_busybox_tar = download_file("http://lake.com/busybox.tar.gz")
+
+store "busybox_store" {
+  inputs = [busybox_tar]
+}
+`), LakeFilename)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	values, diags := parseBody(Package{files: []File{file}}, nil)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+
+	recipe := downloadFileRecipe("http://lake.com/busybox.tar.gz", "")
+	generated, found := values[generatedStoreKey(recipe)]
+	if !found {
+		t.Fatalf("generated store not found in %v", values)
+	}
+	assert.Equal(t, recipe, *generated.recipe)
+	// Identical calls resolve to a single store
+	assert.Len(t, values, 4)
+	assert.Equal(t, recipe.ctyString(), values["also_busybox_tar"].toCtyValue())
+	assert.Equal(t, []string{"{{ " + recipe.Hash() + " }}"}, values["busybox_store"].recipe.Inputs)
+}
+
+func TestRecipeSystem(t *testing.T) {
+	file, diags := parseHCL([]byte(`
+store "host" {}
+store "other" {
+  system = "plan9-386"
+}
+`), LakeFilename)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	values, diags := parseBody(Package{files: []File{file}}, nil)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	assert.Equal(t, HostSystem(), values["host"].recipe.System)
+	assert.Equal(t, "plan9-386", values["other"].recipe.System)
+
+	crossValues, diags := parseBody(Package{files: []File{file}, system: "plan9-386"}, nil)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	assert.Equal(t, "plan9-386", crossValues["host"].recipe.System)
+	// The system takes part in the hash
+	assert.NotEqual(t, values["host"].recipe.Hash(), crossValues["host"].recipe.Hash())
+
+	// The busybox binary in lib/ only runs on x86_64 linux
+	ws := NewWorkspace("../..")
+	ws.System = "plan9-386"
+	busybox, _, diags := ws.ParseDirectory("../../lib/busybox")
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	assert.Equal(t, "linux-amd64", busybox["busybox_store"].recipe.System)
+	assert.Equal(t, "plan9-386", busybox["busybox_tar"].recipe.System)
+}
+
+func TestValueAccessors(t *testing.T) {
+	_, values := parseTestPackage(t, `
+name    = "lake"
+count   = 3
+enabled = true
+list    = ["a", a]
+env     = { FOO = "bar" }
+
+store "a" {
+  script = "echo a > $out/a"
+}
+`)
+	for name, kind := range map[string]Kind{
+		"name": StringKind, "count": NumberKind, "enabled": BoolKind,
+		"list": ListKind, "env": MapKind, "a": RecipeKind, "missing": NullKind,
+	} {
+		assert.Equal(t, kind, values[name].Kind(), name)
+	}
+
+	s, ok := values["name"].AsString()
+	assert.True(t, ok)
+	assert.Equal(t, "lake", s)
+	_, ok = values["count"].AsString()
+	assert.False(t, ok)
+
+	n, _ := values["count"].AsNumber()
+	assert.Equal(t, float64(3), n)
+	b, _ := values["enabled"].AsBool()
+	assert.True(t, b)
+
+	recipe, found := values["a"].Recipe()
+	assert.True(t, found)
+	list, ok := values["list"].AsList()
+	assert.True(t, ok)
+	assert.Len(t, list, 2)
+	first, _ := list[0].AsString()
+	assert.Equal(t, "a", first)
+	reference, _ := list[1].AsString()
+	assert.Equal(t, referenceString(recipe.Hash()), reference)
+
+	env, ok := values["env"].AsMap()
+	assert.True(t, ok)
+	foo, _ := env["FOO"].AsString()
+	assert.Equal(t, "bar", foo)
+}
+
+func TestRecipeRangeAndDependencies(t *testing.T) {
+	builder, values := parseTestPackage(t, `
+store "a" {
+  script = "echo a > $out/a"
+}
+
+store "b" {
+  inputs = [a]
+  script = "echo ${download_file("http://lake.com/b.sh")}"
+}
+`)
+	a, _ := values["a"].Recipe()
+	b, _ := values["b"].Recipe()
+	rng := b.Range()
+	assert.Equal(t, filepath.Join(b.Dir(), LakeFilename), rng.Filename)
+	assert.Equal(t, 6, rng.Start.Line)
+	assert.Equal(t, 1, rng.Start.Column)
+
+	dependencies, err := builder.workspace.Dependencies(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, dependency := range dependencies {
+		names = append(names, dependency.Name)
+		if dependency.Name == a.Name {
+			assert.Equal(t, a.Hash(), dependency.Hash())
+		} else {
+			// Generated recipes have no range
+			assert.Equal(t, hcl.Range{}, dependency.Range())
+		}
+	}
+	assert.ElementsMatch(t, []string{"a", DownloadFileFunctionName}, names)
+}
+
+func TestLocalsAreNotExported(t *testing.T) {
+	lib, diags := parseHCL([]byte(`
+locals {
+  secret = "hunter2"
+}
+
+public = "${secret}!"
+`), LakeFilename)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	libValues, diags := parseBody(Package{files: []File{lib}}, nil)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	secret, _ := libValues["secret"].AsString()
+	assert.Equal(t, "hunter2", secret)
+
+	importLib := func(name string) (map[string]Value, hcl.Diagnostics) { return libValues, nil }
+	parseImporter := func(src string) (map[string]Value, hcl.Diagnostics) {
+		file, diags := parseHCL([]byte(src), LakeFilename)
+		if diags.HasErrors() {
+			t.Fatal(diags)
+		}
+		return parseBody(Package{files: []File{file}}, importLib)
+	}
+	values, diags := parseImporter(`
+import = ["lib"]
+public = lib.public
+`)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	public, _ := values["public"].AsString()
+	assert.Equal(t, "hunter2!", public)
+
+	_, diags = parseImporter(`
+import = ["lib"]
+secret = lib.secret
+`)
+	if assert.True(t, diags.HasErrors()) {
+		assert.Equal(t, "Unsupported attribute", diags[0].Summary)
+	}
+}
+
+func TestConfigDefaults(t *testing.T) {
+	parse := func(src string) map[string]Value {
+		dir := t.TempDir()
+		for name, contents := range map[string]string{
+			LakeFilename: src, "go.mod": "module m\n", "go.sum": "", "main.go": "package main\n",
+		} {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		values, _, diags := parseDirectory(dir, Package{}, nil)
+		if diags.HasErrors() {
+			t.Fatal(diags)
+		}
+		return values
+	}
+	values := parse(`
+store "base" {}
+
+store "tools" {
+  inputs = [base]
+}
+
+config {
+  env    = { CGO_ENABLED = "0", GOFLAGS = "-mod=mod" }
+  inputs = [tools, "./go.mod"]
+}
+
+config {
+  inputs = ["./go.sum"]
+}
+
+store "merged" {
+  env    = { GOFLAGS = "-trimpath" }
+  inputs = ["./go.mod", "./main.go"]
+}
+
+store "overridden" {
+  override = true
+  inputs   = ["./main.go", "./main.go"]
+}
+`)
+	tools, _ := values["tools"].Recipe()
+	merged, _ := values["merged"].Recipe()
+	// The recipe's env takes precedence and duplicate inputs are dropped,
+	// whether or not the config has inputs
+	assert.Equal(t, map[string]string{"CGO_ENABLED": "0", "GOFLAGS": "-trimpath"}, merged.Env)
+	assert.Equal(t, []string{tools.ctyString().AsString(), "./go.mod", "./go.sum", "./main.go"}, merged.Inputs)
+	assert.Contains(t, merged.JSON(), `"CGO_ENABLED":"0"`)
+
+	overridden, _ := values["overridden"].Recipe()
+	assert.Nil(t, overridden.Env)
+	assert.Equal(t, []string{"./main.go"}, overridden.Inputs)
+	plain, _ := parse(`
+store "plain" {
+  inputs = ["./go.mod", "./main.go", "./go.mod"]
+}
+`)["plain"].Recipe()
+	assert.Equal(t, []string{"./go.mod", "./main.go"}, plain.Inputs)
+
+	// Recipes the config refers to, and their dependencies, are decoded
+	// before it and don't get its defaults
+	base, _ := values["base"].Recipe()
+	assert.Nil(t, tools.Env)
+	assert.Equal(t, []string{base.ctyString().AsString()}, tools.Inputs)
+	assert.Nil(t, base.Env)
+	assert.Empty(t, base.Inputs)
+
+	// The merged values are what's hashed
+	explicit, _ := parse(`
+store "base" {}
+
+store "tools" {
+  inputs = [base]
+}
+
+store "merged" {
+  override = true
+  env      = { CGO_ENABLED = "0", GOFLAGS = "-trimpath" }
+  inputs   = [tools, "./go.mod", "./go.sum", "./main.go"]
+}
+`)["merged"].Recipe()
+	assert.Equal(t, explicit.Hash(), merged.Hash())
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package lake
+
+import "os/exec"
+
+func startProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup only kills cmd, processes it started are left running
+func killProcessGroup(cmd *exec.Cmd) {
+	_ = cmd.Process.Kill()
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package lake
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// startProcessGroup makes cmd run in its own process group so that everything
+// it starts can be killed together. It also keeps an interrupt from the
+// terminal from reaching the script before lake has decided what to do.
+func startProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup kills cmd and everything it started
+func killProcessGroup(cmd *exec.Cmd) {
+	_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,281 @@
+package lake
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Progress is told what a LocalBuilder is doing so that it can be displayed. Its
+// methods can be called from more than one goroutine.
+type Progress interface {
+	// Planned is called with the number of stores that will be built or
+	// substituted, it's called again if more are found
+	Planned(n int)
+	// Started is called when a store starts building or being substituted
+	Started(recipe Recipe)
+	// Output is called with each line a build writes to stdout or stderr
+	Output(recipe Recipe, line string, stderr bool)
+	// Finished is called when a store has been built, err is the reason the
+	// build failed
+	Finished(recipe Recipe, err error)
+}
+
+// NewProgress picks how to show build progress. When stdout and stderr are
+// both terminals and $NO_COLOR isn't set builds are shown with a
+// TerminalProgress, otherwise a LineProgress is used. Output that is
+// redirected, like `lake build > paths.txt`, gets plain lines. The returned
+// function must be called once building is done.
+func NewProgress(stdout, stderr *os.File) (Progress, func()) {
+	if os.Getenv("NO_COLOR") != "" || !terminal.IsTerminal(int(stdout.Fd())) ||
+		!terminal.IsTerminal(int(stderr.Fd())) {
+		return NewLineProgress(stdout, stderr), func() {}
+	}
+	width, _, err := terminal.GetSize(int(stderr.Fd()))
+	if err != nil {
+		width = 80
+	}
+	progress := NewTerminalProgress(stderr, width)
+	stop := progress.Start(100 * time.Millisecond)
+	return progress, stop
+}
+
+// outputProgress writes build output prefixed with the recipe name and
+// ignores everything else. It's what a LocalBuilder uses if it isn't given a
+// Progress.
+type outputProgress struct {
+	lock   sync.Mutex
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func (p *outputProgress) Planned(int)                     {}
+func (p *outputProgress) Started(Recipe)                  {}
+func (p *outputProgress) Finished(recipe Recipe, _ error) {}
+
+// Output writes whole lines while holding the lock so that the output of
+// builds running at the same time is interleaved by line
+func (p *outputProgress) Output(recipe Recipe, line string, stderr bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	w := p.stdout
+	if stderr {
+		w = p.stderr
+	}
+	fmt.Fprintf(w, "%s> %s\n", recipe.Name, line)
+}
+
+// LineProgress is plain line oriented output for logs and pipes. Build output
+// is written prefixed with the recipe name and a line is written to stderr as
+// each store starts and finishes.
+type LineProgress struct {
+	outputProgress
+
+	total     int
+	completed int
+	started   map[string]time.Time
+}
+
+// NewLineProgress returns a LineProgress writing to stdout and stderr
+func NewLineProgress(stdout, stderr io.Writer) *LineProgress {
+	return &LineProgress{
+		outputProgress: outputProgress{stdout: stdout, stderr: stderr},
+		started:        map[string]time.Time{},
+	}
+}
+
+func (p *LineProgress) Planned(n int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.total += n
+}
+
+func (p *LineProgress) Started(recipe Recipe) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, found := p.started[recipe.Hash()]; found {
+		return
+	}
+	p.started[recipe.Hash()] = time.Now()
+	fmt.Fprintf(p.stderr, "building %s\n", recipe.Name)
+}
+
+func (p *LineProgress) Finished(recipe Recipe, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	elapsed := time.Since(p.started[recipe.Hash()]).Round(time.Millisecond)
+	delete(p.started, recipe.Hash())
+	if err != nil {
+		fmt.Fprintf(p.stderr, "failed %s after %s\n", recipe.Name, elapsed)
+		return
+	}
+	p.completed++
+	fmt.Fprintf(p.stderr, "[%d/%d] built %s in %s\n", p.completed, p.total, recipe.Name, elapsed)
+}
+
+// terminalTailLines is the number of lines of output shown for each running
+// build
+const terminalTailLines = 3
+
+// TerminalProgress is a live status display. Below the output that has been
+// printed it redraws a summary of the completed and total builds and, for
+// each running build, its elapsed time and the last lines of its output. The
+// full output of every build is in its log, when a build fails the tail of its
+// output is printed along with the error.
+type TerminalProgress struct {
+	lock      sync.Mutex
+	w         io.Writer
+	width     int
+	total     int
+	completed int
+	running   map[string]*runningBuild
+	// drawn is the number of status lines currently on screen
+	drawn int
+}
+
+type runningBuild struct {
+	name    string
+	started time.Time
+	tail    []string
+}
+
+// NewTerminalProgress returns a TerminalProgress that draws to w, a terminal
+// that is width columns wide
+func NewTerminalProgress(w io.Writer, width int) *TerminalProgress {
+	return &TerminalProgress{w: w, width: width, running: map[string]*runningBuild{}}
+}
+
+// Start redraws the display every interval so that elapsed times stay
+// current. The returned function stops redrawing and clears the status lines.
+func (p *TerminalProgress) Start(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				p.lock.Lock()
+				p.redraw()
+				p.lock.Unlock()
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		p.clear()
+	}
+}
+
+func (p *TerminalProgress) Planned(n int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.total += n
+	p.redraw()
+}
+
+func (p *TerminalProgress) Started(recipe Recipe) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, found := p.running[recipe.Hash()]; !found {
+		p.running[recipe.Hash()] = &runningBuild{name: recipe.Name, started: time.Now()}
+	}
+	p.redraw()
+}
+
+func (p *TerminalProgress) Output(recipe Recipe, line string, _ bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	build, found := p.running[recipe.Hash()]
+	if !found {
+		return
+	}
+	build.tail = append(build.tail, line)
+	if len(build.tail) > terminalTailLines {
+		build.tail = build.tail[len(build.tail)-terminalTailLines:]
+	}
+	p.redraw()
+}
+
+func (p *TerminalProgress) Finished(recipe Recipe, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	build := p.running[recipe.Hash()]
+	delete(p.running, recipe.Hash())
+	p.clear()
+	if build == nil {
+		build = &runningBuild{name: recipe.Name, started: time.Now()}
+	}
+	elapsed := formatElapsed(time.Since(build.started))
+	if err != nil {
+		fmt.Fprintf(p.w, "\x1b[31mfailed\x1b[0m %s after %s\n", build.name, elapsed)
+		for _, line := range build.tail {
+			fmt.Fprintf(p.w, "  %s> %s\n", build.name, line)
+		}
+	} else {
+		p.completed++
+		fmt.Fprintf(p.w, "\x1b[32mbuilt\x1b[0m %s in %s\n", build.name, elapsed)
+	}
+	p.redraw()
+}
+
+// clear erases the status lines, the cursor is left where they started
+func (p *TerminalProgress) clear() {
+	if p.drawn > 0 {
+		fmt.Fprintf(p.w, "\x1b[%dA\x1b[J", p.drawn)
+		p.drawn = 0
+	}
+}
+
+func (p *TerminalProgress) redraw() {
+	lines := []string{fmt.Sprintf("\x1b[1m[%d/%d]\x1b[0m %d running", p.completed, p.total, len(p.running))}
+	builds := make([]*runningBuild, 0, len(p.running))
+	for _, build := range p.running {
+		builds = append(builds, build)
+	}
+	sort.Slice(builds, func(i, j int) bool { return builds[i].started.Before(builds[j].started) })
+	for _, build := range builds {
+		lines = append(lines, fmt.Sprintf("  %s %s", build.name, formatElapsed(time.Since(build.started))))
+		for _, line := range build.tail {
+			lines = append(lines, "    "+truncate(line, p.width-4))
+		}
+	}
+	var sb strings.Builder
+	if p.drawn > 0 {
+		fmt.Fprintf(&sb, "\x1b[%dA\x1b[J", p.drawn)
+	}
+	for _, line := range lines {
+		sb.WriteString(line + "\n")
+	}
+	_, _ = io.WriteString(p.w, sb.String())
+	p.drawn = len(lines)
+}
+
+func formatElapsed(d time.Duration) string {
+	return d.Round(100 * time.Millisecond).String()
+}
+
+// truncate shortens a line so that it doesn't wrap, which would throw off the
+// count of lines to clear
+func truncate(line string, width int) string {
+	line = strings.ReplaceAll(line, "\t", "    ")
+	runes := []rune(line)
+	if width < 1 || len(runes) <= width {
+		return line
+	}
+	return string(runes[:width-1]) + "…"
+}
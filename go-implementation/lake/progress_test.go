@@ -0,0 +1,77 @@
+package lake
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLineProgress(t *testing.T) {
+	builder, values := parseTestPackage(t, `
+store "a" {
+  script = "echo a"
+}
+store "b" {
+  inputs = [a]
+  script = "echo b"
+}
+`)
+	var stdout, stderr bytes.Buffer
+	builder.Progress = NewLineProgress(&stdout, &stderr)
+	buildTestRecipe(t, builder, values, "b")
+	// Already built, nothing is planned
+	buildTestRecipe(t, builder, values, "b")
+
+	assert.Equal(t, "a> a\nb> b\n", stdout.String())
+	durations := regexp.MustCompile(`in [0-9.]+m?s`)
+	assert.Equal(t, "building a\n[1/2] built a in X\nbuilding b\n[2/2] built b in X\n",
+		durations.ReplaceAllString(stderr.String(), "in X"))
+}
+
+// stripEscapes removes the terminal escape codes from TerminalProgress output
+func stripEscapes(s string) string {
+	return regexp.MustCompile("\x1b\\[[0-9]*[A-Za-z]").ReplaceAllString(s, "")
+}
+
+func TestTerminalProgress(t *testing.T) {
+	var out bytes.Buffer
+	progress := NewTerminalProgress(&out, 20)
+	a, b := Recipe{Name: "a", Script: "a"}, Recipe{Name: "b", Script: "b"}
+
+	progress.Planned(2)
+	progress.Started(a)
+	for _, line := range []string{"one", "two", "three", "four", "a line that is longer than the terminal"} {
+		progress.Output(a, line, false)
+	}
+	out.Reset()
+	progress.Started(b)
+	assert.Equal(t, "\x1b[5A\x1b[J", out.String()[:len("\x1b[5A\x1b[J")],
+		"the previous status lines are cleared")
+	status := regexp.MustCompile(`[0-9.]+m?s\n`).ReplaceAllString(stripEscapes(out.String()), "Xs\n")
+	assert.Equal(t, strings.Join([]string{
+		"[0/2] 2 running",
+		"  a Xs",
+		"    three",
+		"    four",
+		"    a line that is …",
+		"  b Xs",
+		"",
+	}, "\n"), status)
+
+	out.Reset()
+	progress.Finished(a, errors.New("exit status 1"))
+	assert.Contains(t, stripEscapes(out.String()), "failed a after")
+	assert.Contains(t, stripEscapes(out.String()),
+		"  a> three\n  a> four\n  a> a line that is longer than the terminal\n[0/2] 1 running\n")
+
+	stop := progress.Start(time.Hour)
+	progress.Finished(b, nil)
+	out.Reset()
+	stop()
+	assert.Equal(t, "\x1b[1A\x1b[J", out.String(), "the status line is cleared when stopped")
+}
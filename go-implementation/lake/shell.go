@@ -0,0 +1,72 @@
+package lake
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ShellEnv builds the inputs of recipe and returns the environment that its
+// script would be run with, with $out set to outPath, along with the shell
+// that the recipe's script would be run with. The store's other outputs are
+// created next to outPath, eg: $lib is outPath-lib. Unless pure is set the host
+// environment is kept underneath: the bin directory of each input is added to
+// the front of the host's $PATH and $HOME is left alone. The recipe's cache
+// directory isn't locked, see LockCacheDirectories.
+func (b *LocalBuilder) ShellEnv(ctx context.Context, recipe Recipe, outPath string, pure bool) (env, shell []string, err error) {
+	resolved, inputs, err := b.resolveReferences(ctx, recipe)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resolved, err = b.replaceCacheDirectory(resolved); err != nil {
+		return nil, nil, err
+	}
+	shell = resolved.Shell
+	if len(shell) == 0 {
+		shell = defaultShell
+	}
+	outputs := map[string]string{defaultOutput: outPath}
+	for _, output := range recipe.outputs()[1:] {
+		outputs[output.name] = outPath + "-" + output.name
+		if err := os.MkdirAll(outputs[output.name], 0755); err != nil {
+			return nil, nil, errors.Wrapf(err, "error creating output directory for %q", recipe.Name)
+		}
+	}
+	env = buildEnv(resolved, inputs, outputs)
+	if pure {
+		return env, shell, nil
+	}
+
+	host := map[string]string{}
+	var order []string
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		if _, found := host[k]; !found {
+			order = append(order, k)
+		}
+		host[k] = v
+	}
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		switch {
+		case k == "HOME" && v == buildHome:
+			continue
+		case k == "PATH" && host[k] != "" && resolved.Env["PATH"] == "":
+			if v != "" {
+				v += string(os.PathListSeparator)
+			}
+			v += host[k]
+		}
+		if _, found := host[k]; !found {
+			order = append(order, k)
+		}
+		host[k] = v
+	}
+	env = nil
+	for _, k := range order {
+		env = append(env, k+"="+host[k])
+	}
+	return env, shell, nil
+}
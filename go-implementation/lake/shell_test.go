@@ -0,0 +1,69 @@
+package lake
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func envMap(env []string) map[string]string {
+	m := map[string]string{}
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		m[k] = v
+	}
+	return m
+}
+
+func TestShellEnv(t *testing.T) {
+	builder, values := parseTestPackage(t, `
+store "tool" {
+  script = "echo tool > $out/tool"
+}
+target "greet" {
+  script = "echo hi"
+}
+store "project" {
+  inputs = [tool, greet]
+  env    = { GREETING = "hi" }
+  script = "true"
+}
+`)
+	project, _ := values["project"].Recipe()
+	tool, _ := values["tool"].Recipe()
+	toolPath := builder.store.OutputPath(tool.Hash())
+	greet, _ := values["greet"].Recipe()
+	greetBin := filepath.Join(builder.store.OutputPath(greet.Hash()), "bin")
+	t.Setenv("PATH", "/usr/bin")
+	t.Setenv("HOME", "/home/me")
+	t.Setenv("EDITOR", "vi")
+
+	env, shell, err := builder.ShellEnv(context.Background(), project, "/tmp/out", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, defaultShell, shell)
+	assert.Equal(t, map[string]string{
+		"PATH":     greetBin,
+		"HOME":     buildHome,
+		"out":      "/tmp/out",
+		"tool":     toolPath,
+		"greet":    filepath.Join(greetBin, "greet"),
+		"GREETING": "hi",
+	}, envMap(env))
+	assert.FileExists(t, filepath.Join(toolPath, "tool"), "inputs are built")
+
+	env, _, err = builder.ShellEnv(context.Background(), project, "/tmp/out", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := envMap(env)
+	assert.Equal(t, greetBin+":/usr/bin", m["PATH"])
+	assert.Equal(t, "/home/me", m["HOME"])
+	assert.Equal(t, "vi", m["EDITOR"])
+	assert.Equal(t, "hi", m["GREETING"])
+	assert.Equal(t, toolPath, m["tool"])
+}
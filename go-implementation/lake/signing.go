@@ -0,0 +1,143 @@
+package lake
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// TrustedPublicKeysEnvVar holds a space separated list of public keys,
+	// substituted outputs must be signed by one of them
+	TrustedPublicKeysEnvVar = "LAKE_TRUSTED_PUBLIC_KEYS"
+	// SecretKeyFileEnvVar is the location of the secret key used to sign
+	// pushed outputs
+	SecretKeyFileEnvVar = "LAKE_SECRET_KEY_FILE"
+)
+
+// SecretKey signs narinfo files. Keys are named so that a cache can be signed
+// by more than one key and so that keys can be rotated. They are encoded as
+// "name:base64-key".
+type SecretKey struct {
+	Name string
+	key  ed25519.PrivateKey
+}
+
+// PublicKey verifies narinfo signatures, it's encoded like SecretKey
+type PublicKey struct {
+	Name string
+	key  ed25519.PublicKey
+}
+
+// GenerateKey creates a new key pair with name
+func GenerateKey(name string) (SecretKey, PublicKey, error) {
+	if name == "" || strings.Contains(name, ":") {
+		return SecretKey{}, PublicKey{}, errors.Errorf("invalid key name %q, it must be non-empty and can't contain a colon", name)
+	}
+	public, secret, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return SecretKey{}, PublicKey{}, errors.Wrap(err, "error generating key")
+	}
+	return SecretKey{Name: name, key: secret}, PublicKey{Name: name, key: public}, nil
+}
+
+func (k SecretKey) String() string { return encodeKey(k.Name, k.key) }
+func (k PublicKey) String() string { return encodeKey(k.Name, k.key) }
+
+// PublicKey returns the public half of the key
+func (k SecretKey) PublicKey() PublicKey {
+	return PublicKey{Name: k.Name, key: k.key.Public().(ed25519.PublicKey)}
+}
+
+func encodeKey(name string, key []byte) string {
+	return name + ":" + base64.StdEncoding.EncodeToString(key)
+}
+
+func decodeKey(s string, size int) (name string, key []byte, err error) {
+	name, encoded, found := strings.Cut(strings.TrimSpace(s), ":")
+	if !found || name == "" {
+		return "", nil, errors.New("key must be in the format name:base64-key")
+	}
+	key, err = base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "invalid key %q", name)
+	}
+	if len(key) != size {
+		return "", nil, errors.Errorf("invalid key %q, expected %d bytes got %d", name, size, len(key))
+	}
+	return name, key, nil
+}
+
+// ParseSecretKey decodes a secret key
+func ParseSecretKey(s string) (SecretKey, error) {
+	name, key, err := decodeKey(s, ed25519.PrivateKeySize)
+	return SecretKey{Name: name, key: key}, err
+}
+
+// ParsePublicKey decodes a public key
+func ParsePublicKey(s string) (PublicKey, error) {
+	name, key, err := decodeKey(s, ed25519.PublicKeySize)
+	return PublicKey{Name: name, key: key}, err
+}
+
+// ReadSecretKeyFile reads a secret key from a file
+func ReadSecretKeyFile(path string) (SecretKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return SecretKey{}, errors.Wrap(err, "error reading secret key")
+	}
+	return ParseSecretKey(string(b))
+}
+
+// ParsePublicKeys decodes a space separated list of public keys
+func ParsePublicKeys(s string) (keys []PublicKey, err error) {
+	for _, field := range strings.Fields(s) {
+		key, err := ParsePublicKey(field)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// fingerprint is the part of the narinfo that is signed. It covers the output
+// location, the content hash and size and the references, everything needed
+// to trust the output and the outputs it pulls in. The compressed file isn't
+// covered so that a cache can recompress outputs without re-signing them.
+func (info NarInfo) fingerprint() string {
+	return fmt.Sprintf("1;%s/%s;%s;%d;%s",
+		info.StoreDir, info.StorePath, info.NarHash, info.NarSize,
+		strings.Join(info.References, ","))
+}
+
+// Sign adds a signature by key to the narinfo
+func (info *NarInfo) Sign(key SecretKey) {
+	sig := ed25519.Sign(key.key, []byte(info.fingerprint()))
+	info.Sigs = append(info.Sigs, encodeKey(key.Name, sig))
+}
+
+// verify returns an error unless the narinfo has a valid signature from one of
+// the trusted keys
+func (info NarInfo) verify(trusted []PublicKey) error {
+	if len(info.Sigs) == 0 {
+		return errors.Errorf("%s is not signed", info.StorePath)
+	}
+	for _, sig := range info.Sigs {
+		name, sigBytes, err := decodeKey(sig, ed25519.SignatureSize)
+		if err != nil {
+			continue
+		}
+		for _, key := range trusted {
+			if key.Name == name && ed25519.Verify(key.key, []byte(info.fingerprint()), sigBytes) {
+				return nil
+			}
+		}
+	}
+	return errors.Errorf("%s has no valid signature from a trusted key", info.StorePath)
+}
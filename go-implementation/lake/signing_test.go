@@ -0,0 +1,64 @@
+package lake
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyEncoding(t *testing.T) {
+	secret, public, err := GenerateKey("cache.example.com-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedSecret, err := ParseSecretKey(secret.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, secret, parsedSecret)
+	assert.Equal(t, public, parsedSecret.PublicKey())
+
+	keys, err := ParsePublicKeys(public.String() + "  " + public.String() + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []PublicKey{public, public}, keys)
+
+	_, err = ParsePublicKey(secret.String())
+	assert.Contains(t, err.Error(), "expected 32 bytes")
+	_, _, err = GenerateKey("has:colon")
+	assert.Error(t, err)
+}
+
+func TestNarInfoSignature(t *testing.T) {
+	secret, public, err := GenerateKey("cache-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := NarInfo{
+		StorePath: "525zavu5llf5gyfyq73x5mys6mrs7vha",
+		StoreDir:  "/lake/store",
+		URL:       "archive/525zavu5llf5gyfyq73x5mys6mrs7vha.tar.gz",
+		FileHash:  "sha256:icpfggjznz3jxnctxtcky55g7zhbsk4u",
+		FileSize:  10,
+		NarHash:   "sha256:x3bfvtwq47ykpkojrojsz2cmcf4w4egb",
+		NarSize:   40,
+	}
+	assert.Error(t, info.verify([]PublicKey{public}))
+	info.Sign(secret)
+	assert.NoError(t, info.verify([]PublicKey{public}))
+	assert.Error(t, info.verify(nil))
+
+	// Every field in the fingerprint is covered
+	for _, tamper := range []func(*NarInfo){
+		func(i *NarInfo) { i.StorePath = "a4ckr4xvftvmjb4brrixkxuhevvmwt5p" },
+		func(i *NarInfo) { i.StoreDir = "/other/store" },
+		func(i *NarInfo) { i.NarHash = "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa" },
+		func(i *NarInfo) { i.NarSize = 41 },
+		func(i *NarInfo) { i.References = []string{"a4ckr4xvftvmjb4brrixkxuhevvmwt5p"} },
+	} {
+		tampered := info
+		tamper(&tampered)
+		assert.Error(t, tampered.verify([]PublicKey{public}))
+	}
+}
@@ -0,0 +1,226 @@
+package lake
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/maxmcd/lake/go-implementation/archive"
+	"github.com/pkg/errors"
+)
+
+var (
+	// StoreRootEnvVar can be set to change the location of the store root
+	StoreRootEnvVar = "LAKE_ROOT"
+)
+
+// Store is the directory on disk that holds the outputs of store recipes along
+// with the persistent caches that recipes can request.
+type Store struct {
+	root string
+}
+
+// DefaultStoreRoot returns the value of $LAKE_ROOT, falling back to
+// ~/.cache/lake
+func DefaultStoreRoot() (string, error) {
+	if root := os.Getenv(StoreRootEnvVar); root != "" {
+		return root, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", errors.Wrap(err, "error finding store root")
+	}
+	return filepath.Join(dir, "lake"), nil
+}
+
+// NewStore creates the store directories at root if they don't exist
+func NewStore(root string) (Store, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return Store{}, errors.Wrap(err, "error resolving store root")
+	}
+	store := Store{root: root}
+	for _, dir := range []string{store.storeDir(), store.cacheDir(), store.logDir(), store.dbDir()} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return Store{}, errors.Wrapf(err, "error creating store directory %q", dir)
+		}
+	}
+	return store, nil
+}
+
+func (s Store) storeDir() string { return filepath.Join(s.root, "store") }
+func (s Store) cacheDir() string { return filepath.Join(s.root, "cache") }
+func (s Store) logDir() string   { return filepath.Join(s.root, "log") }
+
+// OutputPath returns the location of a store recipe's output
+func (s Store) OutputPath(hash string) string {
+	return filepath.Join(s.storeDir(), hash)
+}
+
+// DerivationPath returns the location of a recipe's derivation
+func (s Store) DerivationPath(hash string) string {
+	return filepath.Join(s.storeDir(), hash+".drv")
+}
+
+// WriteDerivation writes the canonical form of drv to the store if it isn't
+// already present
+func (s Store) WriteDerivation(drv Derivation) error {
+	path := s.DerivationPath(drv.Hash())
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	return writeFileAtomic(path, drv.Canonical(), 0444)
+}
+
+// ReadDerivation reads a derivation from the store
+func (s Store) ReadDerivation(hash string) (Derivation, error) {
+	b, err := os.ReadFile(s.DerivationPath(hash))
+	if err != nil {
+		return Derivation{}, errors.Wrapf(err, "error reading derivation %s", hash)
+	}
+	return ParseDerivation(b)
+}
+
+// OutputHashPath returns the location of the content hash of a store
+// recipe's output
+func (s Store) OutputHashPath(hash string) string {
+	return filepath.Join(s.storeDir(), hash+".outhash")
+}
+
+// WriteOutputHash hashes the archive of a store recipe's output and records it
+// next to the output. The hash is returned.
+func (s Store) WriteOutputHash(hash string) (string, error) {
+	outputHash, err := hashOutput(s.OutputPath(hash))
+	if err != nil {
+		return "", err
+	}
+	return outputHash, writeFileAtomic(s.OutputHashPath(hash), []byte(outputHash+"\n"), 0444)
+}
+
+// OutputHash returns the recorded content hash of a store recipe's output
+func (s Store) OutputHash(hash string) (string, error) {
+	b, err := os.ReadFile(s.OutputHashPath(hash))
+	if err != nil {
+		return "", errors.Wrapf(err, "error reading output hash of %s", hash)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// hashOutput returns the content hash of the file or directory at path, the
+// sha256 of its archive
+func hashOutput(path string) (string, error) {
+	sum, err := archive.Hash(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "error hashing %q", path)
+	}
+	return "sha256:" + bytesToBase32Hash(sum), nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place so that readers never see a partially written file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-"+filepath.Base(path))
+	if err != nil {
+		return errors.Wrapf(err, "error writing %q", path)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return errors.Wrapf(err, "error writing %q", path)
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrapf(err, "error writing %q", path)
+	}
+	if err := os.Chmod(f.Name(), perm); err != nil {
+		return errors.Wrapf(err, "error writing %q", path)
+	}
+	return errors.Wrapf(os.Rename(f.Name(), path), "error writing %q", path)
+}
+
+// cacheSuffixLength is the length of the suffix cache directories have that
+// identifies the package of the recipe they belong to
+const cacheSuffixLength = 8
+
+// CacheDirectory returns the location of the cache directory for recipes with
+// the given name in the package whose directory is pkg. Recipes with the same
+// name in different packages have their own cache directories. The name must
+// be a single path component so that the directory is always within the
+// store's cache directory.
+func (s Store) CacheDirectory(pkg, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') ||
+		strings.ContainsRune(name, filepath.Separator) {
+		return "", errors.Errorf("%q can't have a cache directory, its name must not be a path", name)
+	}
+	sum := sha256.Sum256([]byte(pkg))
+	suffix := bytesToBase32Hash(sum[:])[:cacheSuffixLength]
+	return filepath.Join(s.cacheDir(), name+"-"+suffix), nil
+}
+
+// LockCacheDirectory creates the cache directory for name in pkg and takes an
+// exclusive lock on it. The returned function releases the lock.
+func (s Store) LockCacheDirectory(pkg, name string) (dir string, unlock func() error, err error) {
+	if dir, err = s.CacheDirectory(pkg, name); err != nil {
+		return "", nil, err
+	}
+	unlock, err = lockCacheDirectory(dir)
+	return dir, unlock, err
+}
+
+func lockCacheDirectory(dir string) (unlock func() error, err error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "error creating cache directory %q", dir)
+	}
+	return lockFile(dir + ".lock")
+}
+
+// CleanCache removes the cache directories of recipes called name in every
+// package, or every cache directory if name is empty. Cache directories that
+// are in use are waited on.
+func (s Store) CleanCache(name string) error {
+	if name != "" {
+		if _, err := s.CacheDirectory("", name); err != nil {
+			return err
+		}
+	}
+	entries, err := os.ReadDir(s.cacheDir())
+	if err != nil {
+		return errors.Wrap(err, "error reading cache directory")
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || (name != "" && (!strings.HasPrefix(entry.Name(), name+"-") ||
+			len(entry.Name()) != len(name)+1+cacheSuffixLength)) {
+			continue
+		}
+		dir := filepath.Join(s.cacheDir(), entry.Name())
+		unlock, err := lockCacheDirectory(dir)
+		if err != nil {
+			return err
+		}
+		err = os.RemoveAll(dir)
+		if unlockErr := unlock(); err == nil {
+			err = unlockErr
+		}
+		if err != nil {
+			return errors.Wrapf(err, "error removing cache directory %q", dir)
+		}
+	}
+	return nil
+}
+
+// lockFile takes an exclusive lock on path, creating it if needed. The lock is
+// held until the returned function is called.
+func lockFile(path string) (unlock func() error, err error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error opening lock file %q", path)
+	}
+	if err := lockFileExclusive(f); err != nil {
+		_ = f.Close()
+		return nil, errors.Wrapf(err, "error locking %q", path)
+	}
+	return func() error {
+		defer f.Close()
+		return unlockFile(f)
+	}, nil
+}
@@ -0,0 +1,303 @@
+package lake
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/maxmcd/dag"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// templateParamsName is the name template bodies refer to their arguments by,
+// eg: param.main
+const templateParamsName = "param"
+
+// templateArgumentName is the instance attribute that refers to the template
+const templateArgumentName = "template"
+
+var templateSchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{
+		{Name: "params", Required: true},
+	},
+	Blocks: []hcl.BlockHeaderSchema{
+		{Type: StoreBlockTypeName},
+		{Type: TargetBlockTypeName},
+	},
+}
+
+// recipeTemplate is a store or target block that's decoded once for each
+// instance of the template, with the instance's arguments as param
+type recipeTemplate struct {
+	name   string
+	params []string
+	// block is the store or target block within the template
+	block *hcl.Block
+	// ctx is the context of the file the template was declared in, template
+	// bodies can refer to anything in their own package
+	ctx *hcl.EvalContext
+	// config is the config of the template's package, it provides the
+	// defaults for the recipes created from the template
+	config config
+}
+
+// templateType is the type templates have when they're referenced, the value
+// is a *recipeTemplate
+var templateType = cty.Capsule("template", reflect.TypeOf(recipeTemplate{}))
+
+// reviewTemplate adds a template to the graph. A template depends on
+// everything its body refers to other than its parameters.
+func (op *orderedParser) reviewTemplate(block *hcl.Block) (diags hcl.Diagnostics) {
+	name := block.Labels[0]
+	if !hclsyntax.ValidIdentifier(name) {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid template name",
+			Detail:   fmt.Sprintf("%q can't be referenced, template names must be valid identifiers.", name),
+			Subject:  rangePointer(block.LabelRanges[0]),
+			Context:  rangePointer(block.DefRange),
+		})
+	}
+	diags = append(diags, op.nameStore.addBlock(name, block)...)
+	op.referencesToParse[name] = toParse{template: block}
+	op.graph.Add(name)
+
+	content, contentDiags := block.Body.Content(templateSchema)
+	if diags = append(diags, contentDiags...); contentDiags.HasErrors() {
+		return diags
+	}
+	if len(content.Blocks) != 1 {
+		return append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid template",
+			Detail:   "A template must contain exactly one store or target block.",
+			Subject:  rangePointer(block.DefRange),
+			Context:  &block.Body.(*hclsyntax.Body).SrcRange,
+		})
+	}
+	variables := append(content.Attributes["params"].Expr.Variables(),
+		hcldec.Variables(content.Blocks[0].Body, recipeSpec)...)
+	for _, variable := range variables {
+		if variable.RootName() == templateParamsName {
+			continue
+		}
+		varName := variableName(variable)
+		op.graph.Add(varName)
+		op.graph.Connect(dag.BasicEdge(name, varName))
+	}
+	return diags
+}
+
+// reviewInstance adds an instance of a template to the graph. Instances
+// depend on their template and on everything their arguments refer to.
+func (op *orderedParser) reviewInstance(block *hcl.Block) (diags hcl.Diagnostics) {
+	name := block.Labels[0]
+	diags = append(diags, op.nameStore.addBlock(name, block)...)
+	op.referencesToParse[name] = toParse{instance: block}
+	op.graph.Add(name)
+
+	attributes, attrDiags := block.Body.JustAttributes()
+	if diags = append(diags, attrDiags...); attrDiags.HasErrors() {
+		return diags
+	}
+	for _, attr := range attributes {
+		for _, variable := range attr.Expr.Variables() {
+			varName := variableName(variable)
+			op.graph.Add(varName)
+			op.graph.Connect(dag.BasicEdge(name, varName))
+		}
+	}
+	return diags
+}
+
+// decodeTemplate checks a template's parameters and makes it available to be
+// referenced by instances
+func (wd *walkDecoder) decodeTemplate(name string, block *hcl.Block) (diags hcl.Diagnostics) {
+	content, diags := block.Body.Content(templateSchema)
+	if diags.HasErrors() {
+		return diags
+	}
+	context := &block.Body.(*hclsyntax.Body).SrcRange
+	ctx := wd.fileEvalContext(block.DefRange.Filename)
+
+	paramsAttr := content.Attributes["params"]
+	var params []string
+	if diags := gohcl.DecodeExpression(paramsAttr.Expr, ctx, &params); diags.HasErrors() {
+		return diags
+	}
+	declared := map[string]struct{}{}
+	for _, param := range params {
+		detail := ""
+		if !hclsyntax.ValidIdentifier(param) {
+			detail = fmt.Sprintf("%q can't be referenced, parameter names must be valid identifiers.", param)
+		} else if _, found := declared[param]; found {
+			detail = fmt.Sprintf("The parameter %q is declared more than once.", param)
+		} else if param == templateArgumentName {
+			detail = fmt.Sprintf("The name %q is reserved for the argument that refers to the template.", param)
+		}
+		if detail != "" {
+			return append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid template parameter",
+				Detail:   detail,
+				Subject:  rangePointer(paramsAttr.Expr.Range()),
+				Context:  context,
+			})
+		}
+		declared[param] = struct{}{}
+	}
+
+	inner := content.Blocks[0]
+	for _, variable := range hcldec.Variables(inner.Body, recipeSpec) {
+		if variable.RootName() != templateParamsName {
+			continue
+		}
+		var attr hcl.TraverseAttr
+		ok := len(variable) > 1
+		if ok {
+			attr, ok = variable[1].(hcl.TraverseAttr)
+		}
+		if !ok {
+			return append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid parameter reference",
+				Detail:   fmt.Sprintf("Parameters are referred to by name, eg: %s.<name>.", templateParamsName),
+				Subject:  rangePointer(variable.SourceRange()),
+				Context:  context,
+			})
+		}
+		if _, found := declared[attr.Name]; !found {
+			return append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Unknown template parameter",
+				Detail:   fmt.Sprintf("The template %q has no parameter named %q.", name, attr.Name),
+				Subject:  rangePointer(variable.SourceRange()),
+				Context:  context,
+			})
+		}
+	}
+
+	value := cty.CapsuleVal(templateType, &recipeTemplate{
+		name:   name,
+		params: params,
+		block:  inner,
+		ctx:    ctx,
+		config: wd.config,
+	})
+	wd.values[name] = Value{cty: &value}
+	wd.evalContext.Variables[name] = value
+	return nil
+}
+
+// decodeInstance decodes the body of a template with the instance's arguments.
+// The recipe is named after the instance and its range is the instance block,
+// instances with the same arguments still have different hashes.
+func (wd *walkDecoder) decodeInstance(name string, block *hcl.Block) (diags hcl.Diagnostics) {
+	attributes, diags := block.Body.JustAttributes()
+	if diags.HasErrors() {
+		return diags
+	}
+	context := &block.Body.(*hclsyntax.Body).SrcRange
+	ctx := wd.fileEvalContext(block.DefRange.Filename)
+
+	templateAttr, found := attributes[templateArgumentName]
+	if !found {
+		return append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Missing template",
+			Detail:   fmt.Sprintf("An instance must refer to the template it's created from with %s = <template>.", templateArgumentName),
+			Subject:  rangePointer(block.DefRange),
+			Context:  context,
+		})
+	}
+	value, diags := templateAttr.Expr.Value(ctx)
+	if diags.HasErrors() {
+		return diags
+	}
+	if !value.Type().Equals(templateType) || value.IsNull() {
+		return append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid template",
+			Detail:   fmt.Sprintf("The value of %s must be a template, not a %s.", templateArgumentName, value.Type().FriendlyName()),
+			Subject:  rangePointer(templateAttr.Expr.Range()),
+			Context:  context,
+		})
+	}
+	tmpl := value.EncapsulatedValue().(*recipeTemplate)
+
+	args := map[string]cty.Value{}
+	for argName, attr := range attributes {
+		if argName == templateArgumentName {
+			continue
+		}
+		if !tmpl.hasParam(argName) {
+			return append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Unsupported argument",
+				Detail:   fmt.Sprintf("The template %q has no parameter named %q.", tmpl.name, argName),
+				Subject:  rangePointer(attr.NameRange),
+				Context:  context,
+			})
+		}
+		if args[argName], diags = attr.Expr.Value(ctx); diags.HasErrors() {
+			return diags
+		}
+	}
+	var missing []string
+	for _, param := range tmpl.params {
+		if _, found := args[param]; !found {
+			missing = append(missing, fmt.Sprintf("%q", param))
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Missing arguments",
+			Detail:   fmt.Sprintf("The template %q requires %s.", tmpl.name, strings.Join(missing, ", ")),
+			Subject:  rangePointer(block.DefRange),
+			Context:  context,
+		})
+	}
+
+	instanceCtx := tmpl.ctx.NewChild()
+	instanceCtx.Variables = map[string]cty.Value{templateParamsName: cty.ObjectVal(args)}
+	// Functions like download_file() register the stores they generate with
+	// the package that's decoding them, which is this one and not the
+	// template's
+	instanceCtx.Functions = wd.evalContext.Functions
+	var recipe Recipe
+	if diags := gohcl.DecodeBody(tmpl.block.Body, instanceCtx, &recipe); diags.HasErrors() {
+		diags = explainOutputReferences(diags, hcldec.Variables(tmpl.block.Body, recipeSpec), instanceCtx, context)
+		for _, diag := range diags {
+			diag.Detail = strings.TrimSpace(fmt.Sprintf("%s Creating %q from the template %q at %s.",
+				diag.Detail, name, tmpl.name, block.DefRange))
+		}
+		return diags
+	}
+	if tmpl.block.Type == StoreBlockTypeName {
+		if diags := validateStoreName(name, block); diags.HasErrors() {
+			return diags
+		}
+	}
+	recipe.defRange = block.DefRange
+	if recipe, diags = wd.completeRecipe(name, recipe, tmpl.block, tmpl.config); diags.HasErrors() {
+		return diags
+	}
+	wd.addRecipe(name, recipe)
+	return nil
+}
+
+func (tmpl *recipeTemplate) hasParam(name string) bool {
+	for _, param := range tmpl.params {
+		if param == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package lake
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImportedTemplate(t *testing.T) {
+	lib, diags := parseHCL([]byte(`
+store "go" {
+  script = "echo go > $out/go"
+}
+
+template "go_binary" {
+  params = ["main"]
+  store {
+    inputs = [go]
+    script = "go build -o $out ./${param.main}"
+  }
+}
+`), "lib.Lakefile")
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	libValues, diags := parseBody(Package{files: []File{lib}}, nil)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	assert.Equal(t, TemplateKind, libValues["go_binary"].Kind())
+
+	file, diags := parseHCL([]byte(`import = ["tools"]
+
+instance "hello" {
+  template = tools.go_binary
+  main     = "cmd/hello"
+}
+
+instance "also_hello" {
+  template = tools.go_binary
+  main     = "cmd/hello"
+}
+
+instance "goodbye" {
+  template = tools.go_binary
+  main     = "cmd/goodbye"
+}
+`), LakeFilename)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	values, diags := parseBody(Package{files: []File{file}}, func(string) (map[string]Value, hcl.Diagnostics) {
+		return libValues, nil
+	})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+
+	goRecipe, _ := libValues["go"].Recipe()
+	hashes := map[string]struct{}{}
+	for i, name := range []string{"hello", "also_hello", "goodbye"} {
+		recipe, found := values[name].Recipe()
+		if !assert.True(t, found, name) {
+			continue
+		}
+		assert.Equal(t, name, recipe.Name)
+		assert.True(t, recipe.IsStore)
+		// Template bodies refer to values in the template's package
+		assert.Equal(t, []string{"{{ " + goRecipe.Hash() + " }}"}, recipe.Inputs)
+		// Each instance has its own range
+		assert.Equal(t, LakeFilename, recipe.Range().Filename)
+		assert.Equal(t, 3+i*5, recipe.Range().Start.Line)
+		hashes[recipe.Hash()] = struct{}{}
+	}
+	assert.Len(t, hashes, 3)
+
+	goodbye, _ := values["goodbye"].Recipe()
+	assert.Equal(t, "go build -o $out ./cmd/goodbye", goodbye.Script)
+}
+
+func TestImportedTemplateGeneratesStores(t *testing.T) {
+	root := t.TempDir()
+	for dir, src := range map[string]string{
+		"tools": `
+template "fetched" {
+  params = ["url"]
+  store {
+    inputs = [download_file(param.url)]
+    script = "true"
+  }
+}
+`,
+		"app": `import = ["lake/tools"]
+
+instance "hello" {
+  template = tools.fetched
+  url      = "http://lake.com/hello.tar.gz"
+}
+`,
+	} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, dir, LakeFilename), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ws := NewWorkspace(root)
+	values, pkg, diags := ws.ParseDirectory(filepath.Join(root, "app"))
+	if diags.HasErrors() {
+		_ = PrintDiagnostics(pkg.FileMap(), diags)
+		t.Fatal(diags)
+	}
+	hello, _ := values["hello"].Recipe()
+	// The store download_file() generated is registered with the package
+	// that created the instance
+	dependencies, err := ws.Dependencies(hello)
+	if assert.NoError(t, err) && assert.Len(t, dependencies, 1) {
+		assert.Equal(t, "http://lake.com/hello.tar.gz", dependencies[0].Env["url"])
+		_, found := values[generatedStoreKey(dependencies[0])]
+		assert.True(t, found)
+	}
+}
@@ -0,0 +1,553 @@
+test "download_file generates a store" {
+  file "Lakefile" {
+    busybox_tar = download_file("http://lake.com/busybox.tar.gz")
+
+    config {
+      shell = ["${busybox_tar}/bin/busybox", "sh"]
+    }
+
+    store "busybox_store" {
+      inputs = [busybox_tar, download_file("http://lake.com/script.sh", "icpfggjznz3jxnctxtcky55g7zhbsk4u")]
+      script = "sh ./script.sh"
+    }
+  }
+}
+
+test "download_file with too many arguments" {
+  err_contains = "download_file takes a url and an optional hash"
+  file "Lakefile" {
+    busybox_tar = download_file("http://lake.com/busybox.tar.gz", "hash", "extra")
+  }
+}
+
+test "download_file with a non-string url" {
+  err_contains = "Invalid function argument"
+  file "Lakefile" {
+    busybox_tar = download_file(["http://lake.com/busybox.tar.gz"])
+  }
+}
+
+test "store names must be valid shell identifiers" {
+  err_contains = "must contain only letters, digits and underscores"
+  file "Lakefile" {
+    store "busybox-store" {
+      script = ""
+    }
+  }
+}
+
+test "store names must not be reserved" {
+  err_contains = "is reserved"
+  file "Lakefile" {
+    store "out" {
+      script = ""
+    }
+  }
+}
+
+test "target names can be commands" {
+  file "Lakefile" {
+    target "say-hi" {
+      script = "echo hi"
+    }
+  }
+}
+
+test "store timeouts must be durations" {
+  err_contains = "isn't a positive duration"
+  file "Lakefile" {
+    store "slow" {
+      timeout = "ten minutes"
+      script  = ""
+    }
+  }
+}
+
+test "targets can't have a timeout" {
+  err_contains = "Only stores are built with a timeout"
+  file "Lakefile" {
+    target "slow" {
+      timeout = "10m"
+      script  = ""
+    }
+  }
+}
+
+test "variables can be referenced" {
+  file "Lakefile" {
+    variable "go_version" {
+      type        = string
+      default     = "1.21"
+      description = "The Go version to build with"
+      validation {
+        condition     = can(regex("^[0-9]+\\.[0-9]+$", go_version))
+        error_message = "The Go version must look like 1.21."
+      }
+    }
+
+    store "go" {
+      env    = { VERSION = go_version }
+      script = "echo $VERSION > $out/version"
+    }
+  }
+}
+
+test "variables must have a value" {
+  err_contains = "The variable \"go_version\" has no default"
+  file "Lakefile" {
+    variable "go_version" {
+      type = string
+    }
+  }
+}
+
+test "variable defaults can't refer to other values" {
+  err_contains = "A variable's default can't refer to other values"
+  file "Lakefile" {
+    version = "1.21"
+    variable "go_version" {
+      default = version
+    }
+  }
+}
+
+test "variable defaults must match the type" {
+  err_contains = "The value of \"versions\" isn't a list of string"
+  file "Lakefile" {
+    variable "versions" {
+      type    = list(string)
+      default = "1.21"
+    }
+  }
+}
+
+test "variables are validated" {
+  err_contains = "The Go version must look like 1.21."
+  file "Lakefile" {
+    variable "go_version" {
+      default = "latest"
+      validation {
+        condition     = can(regex("^[0-9]+\\.[0-9]+$", go_version))
+        error_message = "The Go version must look like 1.21."
+      }
+    }
+  }
+}
+
+test "validation conditions can only refer to the variable" {
+  err_contains = "The condition can only refer to the variable \"go_version\""
+  file "Lakefile" {
+    other = "1.21"
+    variable "go_version" {
+      default = "1.21"
+      validation {
+        condition     = go_version == other
+        error_message = "Must match."
+      }
+    }
+  }
+}
+
+test "variable names can't conflict" {
+  err_contains = "Duplicate name"
+  file "Lakefile" {
+    go_version = "1.20"
+    variable "go_version" {
+      default = "1.21"
+    }
+  }
+}
+
+test "locals can be referenced" {
+  file "Lakefile" {
+    locals {
+      greeting = "hello ${name}"
+      name     = "lake"
+    }
+
+    store "greet" {
+      script = "echo ${greeting} > $out/greeting"
+    }
+  }
+  file "other.Lakefile" {
+    shout = "${greeting}!"
+  }
+}
+
+test "local names can't conflict" {
+  err_contains = "Duplicate name"
+  file "Lakefile" {
+    name = "lake"
+    locals {
+      name = "also lake"
+    }
+  }
+}
+
+test "local names can't conflict across locals blocks" {
+  err_contains = "Duplicate name"
+  file "Lakefile" {
+    locals {
+      name = "lake"
+    }
+    locals {
+      name = "also lake"
+    }
+  }
+}
+
+test "locals can't have blocks" {
+  err_contains = "Unexpected \"store\" block"
+  file "Lakefile" {
+    locals {
+      store "nested" {}
+    }
+  }
+}
+
+test "locals must come after imports" {
+  err_contains = "Import statement must be the first attribute defined in a file."
+  file "Lakefile" {
+    locals {
+      name = "lake"
+    }
+    import = ["lake/lib/busybox"]
+  }
+}
+
+test "templates can be instantiated" {
+  file "Lakefile" {
+    template "go_binary" {
+      params = ["main"]
+      store {
+        inputs = ["./${param.main}/*.go"]
+        script = "go build -o $out ./${param.main}"
+      }
+    }
+
+    instance "hello" {
+      template = go_binary
+      main     = "cmd/hello"
+    }
+
+    store "uses_hello" {
+      inputs = [hello]
+    }
+  }
+}
+
+test "templates must have a store or target" {
+  err_contains = "A template must contain exactly one store or target block."
+  file "Lakefile" {
+    template "empty" {
+      params = []
+    }
+  }
+}
+
+test "template bodies can only refer to declared parameters" {
+  err_contains = "The template \"go_binary\" has no parameter named \"mian\"."
+  file "Lakefile" {
+    template "go_binary" {
+      params = ["main"]
+      store {
+        script = "go build ./${param.mian}"
+      }
+    }
+  }
+}
+
+test "instances must give every parameter" {
+  err_contains = "The template \"go_binary\" requires \"main\"."
+  file "Lakefile" {
+    template "go_binary" {
+      params = ["main"]
+      store {
+        script = "go build ./${param.main}"
+      }
+    }
+    instance "hello" {
+      template = go_binary
+    }
+  }
+}
+
+test "instances can't give unknown arguments" {
+  err_contains = "The template \"go_binary\" has no parameter named \"extra\"."
+  file "Lakefile" {
+    template "go_binary" {
+      params = ["main"]
+      store {
+        script = "go build ./${param.main}"
+      }
+    }
+    instance "hello" {
+      template = go_binary
+      main     = "cmd/hello"
+      extra    = true
+    }
+  }
+}
+
+test "instances must refer to a template" {
+  err_contains = "The value of template must be a template, not a string."
+  file "Lakefile" {
+    not_a_template = "go_binary"
+    instance "hello" {
+      template = not_a_template
+    }
+  }
+}
+
+test "store instances must have valid store names" {
+  err_contains = "must contain only letters, digits and underscores"
+  file "Lakefile" {
+    template "go_binary" {
+      params = []
+      store {}
+    }
+    instance "hello-world" {
+      template = go_binary
+    }
+  }
+}
+
+test "for_each creates a recipe for each element" {
+  file "Lakefile" {
+    store "go" {
+      for_each = {
+        "1.20" = "https://go.dev/dl/go1.20.linux-amd64.tar.gz"
+        "1.21" = "https://go.dev/dl/go1.21.0.linux-amd64.tar.gz"
+      }
+      script = "echo ${each.key} ${each.value} > $out/version"
+    }
+
+    target "test" {
+      for_each = ["1.20", "1.21"]
+      script   = "${go[each.key]}/bin/go test ./..."
+    }
+
+    store "latest" {
+      inputs = [go["1.21"]]
+    }
+  }
+}
+
+test "for_each must be a map or a list of strings" {
+  err_contains = "The for_each value must be a map or a list of strings, not a string."
+  file "Lakefile" {
+    store "go" {
+      for_each = "1.21"
+    }
+  }
+}
+
+test "for_each lists can't have duplicates" {
+  err_contains = "The key \"1.21\" is in the list given to for_each more than once."
+  file "Lakefile" {
+    store "go" {
+      for_each = ["1.21", "1.21"]
+    }
+  }
+}
+
+test "for_each names can't conflict" {
+  err_contains = "Duplicate name"
+  file "Lakefile" {
+    target "go[\"1.21\"]" {}
+    target "go" {
+      for_each = ["1.21"]
+    }
+  }
+}
+
+test "each is only available with for_each" {
+  err_contains = "There is no variable named \"each\"."
+  file "Lakefile" {
+    store "go" {
+      script = "echo ${each.key}"
+    }
+  }
+}
+
+test "config env can only be set once per variable" {
+  err_contains = "The env variable \"GOFLAGS\" is set by more than one config block."
+  file "Lakefile" {
+    config {
+      env = { GOFLAGS = "-mod=mod" }
+    }
+  }
+  file "other.Lakefile" {
+    config {
+      env = { GOFLAGS = "-trimpath" }
+    }
+  }
+}
+
+test "override must be a bool" {
+  err_contains = "Unsuitable value type"
+  file "Lakefile" {
+    store "a" {
+      override = "yes please"
+    }
+  }
+}
+
+test "outputs can be referenced by name" {
+  file "Lakefile" {
+    app = "${stdenv.lib}/lib"
+
+    store "stdenv" {
+      outputs = ["out", "lib", "dev"]
+      script  = "echo > $lib/libc"
+    }
+  }
+}
+
+test "outputs must include out" {
+  err_contains = "Every store has the output \"out\""
+  file "Lakefile" {
+    store "stdenv" {
+      outputs = ["lib"]
+    }
+  }
+}
+
+test "outputs must be valid variable names" {
+  err_contains = "\"dev-tools\" can't be used as an output name"
+  file "Lakefile" {
+    store "stdenv" {
+      outputs = ["out", "dev-tools"]
+    }
+  }
+}
+
+test "outputs can't be set by the builder" {
+  err_contains = "\"PATH\" is set by the builder"
+  file "Lakefile" {
+    store "stdenv" {
+      outputs = ["out", "PATH"]
+    }
+  }
+}
+
+test "outputs must be unique" {
+  err_contains = "The output \"lib\" is listed more than once."
+  file "Lakefile" {
+    store "stdenv" {
+      outputs = ["out", "lib", "lib"]
+    }
+  }
+}
+
+test "outputs can't have the name of an input" {
+  err_contains = "An input is bound to $lib, which is where the output \"lib\" is set"
+  file "Lakefile" {
+    store "lib" {}
+
+    store "stdenv" {
+      inputs  = [lib]
+      outputs = ["out", "lib"]
+    }
+  }
+}
+
+test "outputs can't have the name of an output of an input" {
+  err_contains = "An input is bound to $stdenv_lib"
+  file "Lakefile" {
+    store "stdenv" {
+      outputs = ["out", "lib"]
+    }
+
+    store "app" {
+      inputs  = [stdenv.lib]
+      outputs = ["out", "stdenv_lib"]
+    }
+  }
+}
+
+test "env can't set out" {
+  err_contains = "The env variable \"out\" would replace the location of the output \"out\""
+  file "Lakefile" {
+    store "stdenv" {
+      env = { out = "/tmp" }
+    }
+  }
+}
+
+test "config env can't set an output" {
+  err_contains = "The env variable \"dev\" would replace the location of the output \"dev\""
+  file "Lakefile" {
+    config {
+      env = { dev = "1" }
+    }
+
+    store "stdenv" {
+      outputs = ["out", "dev"]
+    }
+  }
+}
+
+test "targets don't have outputs" {
+  err_contains = "Only stores have outputs"
+  file "Lakefile" {
+    target "run" {
+      outputs = ["out", "lib"]
+    }
+  }
+}
+
+test "only declared outputs can be referenced" {
+  err_contains = "This object does not have an attribute named \"doc\"."
+  file "Lakefile" {
+    store "stdenv" {
+      outputs = ["out", "lib"]
+    }
+    store "app" {
+      script = "ls ${stdenv.doc}"
+    }
+  }
+}
+
+test "outputs with only out are the same as no outputs" {
+  err_contains = "leave it out so that the store can be referenced by name"
+  file "Lakefile" {
+    store "stdenv" {
+      outputs = ["out"]
+    }
+  }
+}
+
+test "stores with outputs must be referenced by output as an input" {
+  err_contains = "stdenv has the outputs lib, out, refer to one of them, eg: stdenv.out."
+  file "Lakefile" {
+    store "stdenv" {
+      outputs = ["out", "lib"]
+    }
+    store "app" {
+      inputs = [stdenv]
+    }
+  }
+}
+
+test "stores with outputs must be referenced by output in a string" {
+  err_contains = "stdenv has the outputs lib, out, refer to one of them, eg: stdenv.out."
+  file "Lakefile" {
+    store "stdenv" {
+      outputs = ["out", "lib"]
+    }
+    bin = "${stdenv}/bin"
+  }
+}
+
+test "stores with outputs can be passed around whole" {
+  file "Lakefile" {
+    store "stdenv" {
+      outputs = ["out", "lib"]
+    }
+    toolchain = stdenv
+    store "app" {
+      inputs = [toolchain.out, toolchain.lib]
+    }
+  }
+}
@@ -0,0 +1,272 @@
+package lake
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/ext/tryfunc"
+	"github.com/hashicorp/hcl/v2/ext/typeexpr"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+	"github.com/zclconf/go-cty/cty/function"
+	"github.com/zclconf/go-cty/cty/function/stdlib"
+)
+
+var (
+	// VariableEnvPrefix is the prefix of environment variables that set the
+	// value of a variable, eg: LAKE_VAR_go_version
+	VariableEnvPrefix = "LAKE_VAR_"
+)
+
+var variableSchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{
+		{Name: "type"},
+		{Name: "default"},
+		{Name: "description"},
+	},
+	Blocks: []hcl.BlockHeaderSchema{
+		{Type: "validation"},
+	},
+}
+
+var validationSchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{
+		{Name: "condition", Required: true},
+		{Name: "error_message", Required: true},
+	},
+}
+
+// validationFunctions are the functions available to validation conditions
+var validationFunctions = map[string]function.Function{
+	"can":      tryfunc.CanFunc,
+	"contains": stdlib.ContainsFunc,
+	"length":   lengthFunc,
+	"regex":    stdlib.RegexFunc,
+}
+
+// lengthFunc is stdlib.LengthFunc that also counts the characters in strings
+var lengthFunc = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{Name: "value", Type: cty.DynamicPseudoType, AllowDynamicType: true, AllowUnknown: true},
+	},
+	Type: function.StaticReturnType(cty.Number),
+	Impl: func(args []cty.Value, _ cty.Type) (cty.Value, error) {
+		if args[0].Type() == cty.String {
+			return stdlib.Strlen(args[0])
+		}
+		return stdlib.Length(args[0])
+	},
+})
+
+// reviewVariable checks a variable block's name. Variables don't depend on
+// anything else in the package so they only need a vertex in the graph.
+func (op *orderedParser) reviewVariable(block *hcl.Block) (diags hcl.Diagnostics) {
+	name := block.Labels[0]
+	if !hclsyntax.ValidIdentifier(name) {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid variable name",
+			Detail:   fmt.Sprintf("%q can't be referenced, variable names must be valid identifiers.", name),
+			Subject:  rangePointer(block.LabelRanges[0]),
+			Context:  rangePointer(block.DefRange),
+		})
+	}
+	diags = append(diags, op.nameStore.addBlock(name, block)...)
+	op.referencesToParse[name] = toParse{variable: block}
+	op.graph.Add(name)
+	return diags
+}
+
+// checkVariableOverrides reports values given for variables that the package
+// doesn't declare
+func (op *orderedParser) checkVariableOverrides() (diags hcl.Diagnostics) {
+	names := make([]string, 0, len(op.pkg.variables))
+	for name := range op.pkg.variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if parse := op.referencesToParse[name]; parse.variable == nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Undeclared variable",
+				Detail:   fmt.Sprintf("A value was given for %q but the package doesn't declare a variable with that name.", name),
+			})
+		}
+	}
+	return diags
+}
+
+// decodeVariable sets the value of a variable. The value comes from, in order
+// of precedence, the package's overrides, the LAKE_VAR_<name> environment
+// variable and the variable's default. It's converted to the variable's type
+// and then checked against each of its validations.
+func (wd *walkDecoder) decodeVariable(name string, block *hcl.Block) (diags hcl.Diagnostics) {
+	content, diags := block.Body.Content(variableSchema)
+	if diags.HasErrors() {
+		return diags
+	}
+	context := &block.Body.(*hclsyntax.Body).SrcRange
+
+	ty := cty.DynamicPseudoType
+	if attr, found := content.Attributes["type"]; found {
+		if ty, diags = typeexpr.TypeConstraint(attr.Expr); diags.HasErrors() {
+			return diags
+		}
+	}
+	if attr, found := content.Attributes["description"]; found {
+		if _, diags := attr.Expr.Value(nil); diags.HasErrors() {
+			return diags
+		}
+	}
+
+	var value cty.Value
+	subject := block.DefRange
+	raw, found := wd.variables[name]
+	source := "the -var flag"
+	if !found && wd.envVariables {
+		raw, found = os.LookupEnv(VariableEnvPrefix + name)
+		source = "$" + VariableEnvPrefix + name
+	}
+	attr, hasDefault := content.Attributes["default"]
+	switch {
+	case found:
+		var err error
+		if value, err = parseVariableValue(raw, ty); err != nil {
+			return append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid value for variable",
+				Detail:   fmt.Sprintf("The value of %q from %s is invalid: %s.", name, source, err),
+				Subject:  &subject,
+				Context:  context,
+			})
+		}
+	case hasDefault:
+		subject = attr.Expr.Range()
+		if len(attr.Expr.Variables()) > 0 {
+			return append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Variables not allowed",
+				Detail:   "A variable's default can't refer to other values.",
+				Subject:  &subject,
+				Context:  context,
+			})
+		}
+		if value, diags = attr.Expr.Value(nil); diags.HasErrors() {
+			return diags
+		}
+	default:
+		return append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "No value for required variable",
+			Detail: fmt.Sprintf("The variable %q has no default, set it with -var %s=<value> or $%s%s.",
+				name, name, VariableEnvPrefix, name),
+			Subject: &subject,
+			Context: context,
+		})
+	}
+	value, err := convert.Convert(value, ty)
+	if err != nil {
+		return append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for variable",
+			Detail:   fmt.Sprintf("The value of %q isn't a %s: %s.", name, ty.FriendlyName(), err),
+			Subject:  &subject,
+			Context:  context,
+		})
+	}
+
+	for _, validation := range content.Blocks {
+		if diags := wd.validateVariable(name, value, validation); diags.HasErrors() {
+			return diags
+		}
+	}
+
+	wd.values[name] = Value{cty: &value}
+	wd.evalContext.Variables[name] = value
+	return nil
+}
+
+// parseVariableValue converts a value given on the command line or in the
+// environment. Values for primitive types are taken as they are, values for
+// collections are HCL expressions like ["a", "b"].
+func parseVariableValue(raw string, ty cty.Type) (cty.Value, error) {
+	if ty.IsPrimitiveType() {
+		return cty.StringVal(raw), nil
+	}
+	expr, diags := hclsyntax.ParseExpression([]byte(raw), "", hcl.Pos{Line: 1, Column: 1})
+	if diags.HasErrors() {
+		return cty.NilVal, diags
+	}
+	value, diags := expr.Value(nil)
+	if diags.HasErrors() {
+		return cty.NilVal, diags
+	}
+	return value, nil
+}
+
+// validateVariable evaluates a validation block's condition with the
+// variable's value in scope. Conditions can only refer to the variable.
+func (wd *walkDecoder) validateVariable(name string, value cty.Value, block *hcl.Block) (diags hcl.Diagnostics) {
+	content, diags := block.Body.Content(validationSchema)
+	if diags.HasErrors() {
+		return diags
+	}
+	condition := content.Attributes["condition"]
+	context := &block.Body.(*hclsyntax.Body).SrcRange
+	for _, traversal := range condition.Expr.Variables() {
+		if traversal.RootName() != name {
+			return append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid validation condition",
+				Detail:   fmt.Sprintf("The condition can only refer to the variable %q.", name),
+				Subject:  rangePointer(traversal.SourceRange()),
+				Context:  context,
+			})
+		}
+	}
+	ctx := &hcl.EvalContext{
+		Variables: map[string]cty.Value{name: value},
+		Functions: validationFunctions,
+	}
+	result, diags := condition.Expr.Value(ctx)
+	if diags.HasErrors() {
+		return diags
+	}
+	if result, err := convert.Convert(result, cty.Bool); err != nil || result.IsNull() {
+		return append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid validation condition",
+			Detail:   "The condition must be a bool.",
+			Subject:  rangePointer(condition.Expr.Range()),
+			Context:  context,
+		})
+	} else if result.True() {
+		return nil
+	}
+
+	message, diags := content.Attributes["error_message"].Expr.Value(nil)
+	if diags.HasErrors() {
+		return diags
+	}
+	if message.Type() != cty.String || message.IsNull() {
+		return append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid validation error message",
+			Detail:   "The error message must be a string.",
+			Subject:  rangePointer(content.Attributes["error_message"].Expr.Range()),
+			Context:  context,
+		})
+	}
+	return append(diags, &hcl.Diagnostic{
+		Severity: hcl.DiagError,
+		Summary:  "Invalid value for variable",
+		Detail:   strings.TrimSpace(message.AsString()),
+		Subject:  rangePointer(condition.Expr.Range()),
+		Context:  context,
+	})
+}
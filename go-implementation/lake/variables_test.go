@@ -0,0 +1,97 @@
+package lake
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+const variablesTestLakefile = `
+variable "greeting" {
+  type    = string
+  default = "hello"
+}
+
+variable "names" {
+  type    = list(string)
+  default = ["world"]
+}
+
+store "greet" {
+  script = "echo ${greeting} ${names[0]} > $out/greeting"
+}
+`
+
+func parseVariablesPackage(t *testing.T, variables map[string]string) (map[string]Value, hcl.Diagnostics) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, LakeFilename), []byte(variablesTestLakefile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ws := NewWorkspace(dir)
+	ws.Variables = variables
+	values, _, diags := ws.ParseDirectory(dir)
+	return values, diags
+}
+
+func stringValue(t *testing.T, v Value) string {
+	t.Helper()
+	s, ok := v.AsString()
+	if !ok {
+		t.Fatalf("%v isn't a string", v.Kind())
+	}
+	return s
+}
+
+func TestVariableOverrides(t *testing.T) {
+	values, diags := parseVariablesPackage(t, nil)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	assert.Equal(t, "hello", stringValue(t, values["greeting"]))
+	defaultRecipe, _ := values["greet"].Recipe()
+
+	t.Setenv(VariableEnvPrefix+"greeting", "hi")
+	values, diags = parseVariablesPackage(t, nil)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	assert.Equal(t, "hi", stringValue(t, values["greeting"]))
+	envRecipe, _ := values["greet"].Recipe()
+	assert.NotEqual(t, defaultRecipe.Hash(), envRecipe.Hash())
+
+	// Values given to the workspace take precedence over the environment
+	values, diags = parseVariablesPackage(t, map[string]string{
+		"greeting": "hey",
+		"names":    `["a", "b"]`,
+	})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	assert.Equal(t, "hey", stringValue(t, values["greeting"]))
+	names, _ := values["names"].AsList()
+	if assert.Len(t, names, 2) {
+		assert.Equal(t, "b", stringValue(t, names[1]))
+	}
+	recipe, _ := values["greet"].Recipe()
+	assert.Contains(t, recipe.Script, "echo hey a")
+}
+
+func TestVariableOverrideErrors(t *testing.T) {
+	for _, tt := range []struct {
+		variables map[string]string
+		summary   string
+	}{
+		{map[string]string{"missing": "x"}, "Undeclared variable"},
+		{map[string]string{"names": `["a"`}, "Invalid value for variable"},
+		{map[string]string{"names": `"a"`}, "Invalid value for variable"},
+	} {
+		_, diags := parseVariablesPackage(t, tt.variables)
+		if assert.True(t, diags.HasErrors(), tt.variables) {
+			assert.Equal(t, tt.summary, diags[0].Summary, tt.variables)
+		}
+	}
+}
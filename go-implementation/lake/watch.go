@@ -0,0 +1,226 @@
+package lake
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// fileWatcher reports changes within directories
+type fileWatcher interface {
+	// Add starts watching the files in dir
+	Add(dir string) error
+	// Events receives the path of each file that changes, it's closed once
+	// the watcher is closed
+	Events() <-chan string
+	// Err returns the error that stopped the watcher, if any
+	Err() error
+	Close() error
+}
+
+// Watcher rebuilds a recipe when the files it depends on change. Every local
+// file input of the recipe and of the recipes it depends on is watched, along
+// with the Lakefiles of their packages.
+//
+// The contents of local files are part of store hashes, so the package is
+// parsed again after every change and the recipe is built as usual. Stores
+// whose files changed have new hashes, the rest are already built.
+type Watcher struct {
+	// Parse loads the package, it's called again when a Lakefile changes
+	Parse func() (*LocalBuilder, map[string]Value, error)
+	// Name is the name of the recipe to build
+	Name string
+	// Run is called after each build
+	Run func(builder *LocalBuilder, recipe Recipe) error
+	// Debounce is how long to wait for changes to stop before rebuilding
+	Debounce time.Duration
+	// Log receives messages about what is being rebuilt and any errors
+	Log io.Writer
+}
+
+// Watch builds the recipe and then rebuilds it as files change until ctx is
+// cancelled. Build errors are written to the log and don't stop the watch.
+func (w *Watcher) Watch(ctx context.Context) (err error) {
+	watcher, err := newFileWatcher()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = watcher.Close()
+		for range watcher.Events() {
+		}
+	}()
+
+	// The package directory is watched so that a broken Lakefile can be fixed
+	if wd, err := os.Getwd(); err == nil {
+		if err := watcher.Add(wd); err != nil {
+			return err
+		}
+	}
+	for {
+		state, err := w.parse()
+		if err != nil {
+			fmt.Fprintf(w.Log, "error: %v\n", err)
+		}
+		if state != nil {
+			if err := state.watch(watcher); err != nil {
+				return err
+			}
+			w.build(ctx, state)
+		}
+
+		changed, ok := w.waitForChanges(ctx, watcher, state)
+		if !ok {
+			return watcher.Err()
+		}
+		fmt.Fprintf(w.Log, "%s changed\n", strings.Join(relativePaths(changed), ", "))
+	}
+}
+
+// watchState is what's known about the recipe after a parse
+type watchState struct {
+	builder *LocalBuilder
+	recipe  Recipe
+	// closure is the recipe and every recipe it depends on
+	closure []Recipe
+	// patterns match the files that are watched
+	patterns []string
+}
+
+func (w *Watcher) parse() (*watchState, error) {
+	builder, values, err := w.Parse()
+	if err != nil {
+		return nil, err
+	}
+	recipe, found := values[w.Name].Recipe()
+	if !found {
+		return nil, errors.Errorf("no store or target named %q", w.Name)
+	}
+	state := &watchState{builder: builder, recipe: recipe}
+	seen := map[string]struct{}{}
+	var walk func(recipe Recipe)
+	walk = func(recipe Recipe) {
+		if _, found := seen[recipe.Hash()]; found {
+			return
+		}
+		seen[recipe.Hash()] = struct{}{}
+		state.closure = append(state.closure, recipe)
+		for _, reference := range recipe.references() {
+			if dependency, found := builder.workspace.Recipe(reference); found {
+				walk(dependency)
+			}
+		}
+	}
+	walk(recipe)
+
+	dirs := map[string]struct{}{}
+	if wd, err := os.Getwd(); err == nil {
+		dirs[wd] = struct{}{}
+	}
+	for _, recipe := range state.closure {
+		if recipe.dir == "" {
+			continue
+		}
+		dirs[recipe.dir] = struct{}{}
+		for _, pattern := range recipe.localInputPatterns() {
+			state.patterns = append(state.patterns, filepath.Join(recipe.dir, pattern))
+		}
+	}
+	for dir := range dirs {
+		state.patterns = append(state.patterns,
+			filepath.Join(dir, LakeFilename), filepath.Join(dir, "*."+LakeFilename))
+	}
+	return state, nil
+}
+
+// watch adds the directories of every watched file to the watcher
+func (s *watchState) watch(watcher fileWatcher) error {
+	for _, pattern := range s.patterns {
+		dirs := []string{filepath.Dir(pattern)}
+		if strings.ContainsAny(dirs[0], `*?[\`) {
+			dirs, _ = filepath.Glob(dirs[0])
+		}
+		for _, dir := range dirs {
+			if err := watcher.Add(dir); err != nil && !os.IsNotExist(errors.Cause(err)) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *watchState) matches(path string) bool {
+	for _, pattern := range s.patterns {
+		if match, _ := filepath.Match(pattern, path); match {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForChanges returns the watched files that change, once no more changes
+// have happened for the debounce interval. ok is false if the watch should
+// stop.
+func (w *Watcher) waitForChanges(ctx context.Context, watcher fileWatcher, state *watchState) (changed []string, ok bool) {
+	seen := map[string]struct{}{}
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, false
+		case path, open := <-watcher.Events():
+			if !open {
+				return nil, false
+			}
+			// Without a parsed package only Lakefiles matter
+			if (state == nil && !isLakefile(path)) || (state != nil && !state.matches(path)) {
+				continue
+			}
+			if _, found := seen[path]; !found {
+				seen[path] = struct{}{}
+				changed = append(changed, path)
+			}
+			timer = time.After(w.Debounce)
+		case <-timer:
+			return changed, true
+		}
+	}
+}
+
+// build builds the recipe and calls Run
+func (w *Watcher) build(ctx context.Context, state *watchState) {
+	if _, err := state.builder.Build(ctx, state.recipe); err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		fmt.Fprintf(w.Log, "error: %v\n", err)
+		return
+	}
+	if w.Run != nil {
+		if err := w.Run(state.builder, state.recipe); err != nil {
+			fmt.Fprintf(w.Log, "error: %v\n", err)
+		}
+	}
+}
+
+func isLakefile(path string) bool {
+	name := filepath.Base(path)
+	return name == LakeFilename || filepath.Ext(name) == "."+LakeFilename
+}
+
+func relativePaths(paths []string) (out []string) {
+	wd, _ := os.Getwd()
+	for _, path := range paths {
+		if rel, err := filepath.Rel(wd, path); err == nil && !strings.HasPrefix(rel, "..") {
+			path = rel
+		}
+		out = append(out, path)
+	}
+	return out
+}
@@ -0,0 +1,152 @@
+//go:build linux
+
+package lake
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// inotifyWatcher watches directories with inotify. Reads are multiplexed with
+// a pipe through epoll so that Close can interrupt a blocked read.
+type inotifyWatcher struct {
+	fd     int
+	epfd   int
+	pipe   [2]int
+	events chan string
+
+	lock    sync.Mutex
+	watches map[int32]string
+	dirs    map[string]struct{}
+	err     error
+}
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY |
+	syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_DELETE | syscall.IN_ATTRIB
+
+func newFileWatcher() (fileWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	w := &inotifyWatcher{
+		fd:      fd,
+		events:  make(chan string),
+		watches: map[int32]string{},
+		dirs:    map[string]struct{}{},
+	}
+	if err := syscall.Pipe2(w.pipe[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		_ = syscall.Close(fd)
+		return nil, os.NewSyscallError("pipe2", err)
+	}
+	if w.epfd, err = syscall.EpollCreate1(syscall.EPOLL_CLOEXEC); err != nil {
+		w.closeFds()
+		return nil, os.NewSyscallError("epoll_create1", err)
+	}
+	for _, fd := range []int{w.fd, w.pipe[0]} {
+		event := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}
+		if err := syscall.EpollCtl(w.epfd, syscall.EPOLL_CTL_ADD, fd, &event); err != nil {
+			w.closeFds()
+			_ = syscall.Close(w.epfd)
+			return nil, os.NewSyscallError("epoll_ctl", err)
+		}
+	}
+	go w.read()
+	return w, nil
+}
+
+func (w *inotifyWatcher) Add(dir string) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if _, found := w.dirs[dir]; found {
+		return nil
+	}
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, inotifyMask)
+	if err != nil {
+		return errors.Wrapf(os.NewSyscallError("inotify_add_watch", err), "error watching %q", dir)
+	}
+	w.watches[int32(wd)] = dir
+	w.dirs[dir] = struct{}{}
+	return nil
+}
+
+func (w *inotifyWatcher) Events() <-chan string { return w.events }
+
+// Err returns the error that stopped the watcher, if any
+func (w *inotifyWatcher) Err() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.err
+}
+
+func (w *inotifyWatcher) Close() error {
+	_, err := syscall.Write(w.pipe[1], []byte{0})
+	return err
+}
+
+func (w *inotifyWatcher) closeFds() {
+	_ = syscall.Close(w.fd)
+	_ = syscall.Close(w.pipe[0])
+	_ = syscall.Close(w.pipe[1])
+}
+
+func (w *inotifyWatcher) stop(err error) {
+	w.lock.Lock()
+	w.err = err
+	w.lock.Unlock()
+	w.closeFds()
+	_ = syscall.Close(w.epfd)
+	close(w.events)
+}
+
+func (w *inotifyWatcher) read() {
+	var buf [64 * (syscall.SizeofInotifyEvent + syscall.NAME_MAX + 1)]byte
+	epollEvents := make([]syscall.EpollEvent, 2)
+	for {
+		n, err := syscall.EpollWait(w.epfd, epollEvents, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			w.stop(os.NewSyscallError("epoll_wait", err))
+			return
+		}
+		for _, event := range epollEvents[:n] {
+			if int(event.Fd) == w.pipe[0] {
+				w.stop(nil)
+				return
+			}
+		}
+
+		n, err = syscall.Read(w.fd, buf[:])
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			w.stop(os.NewSyscallError("read", err))
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			w.lock.Lock()
+			dir, found := w.watches[event.Wd]
+			w.lock.Unlock()
+			if !found {
+				continue
+			}
+			name := string(nameBytes)
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+			w.events <- filepath.Join(dir, name)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package lake
+
+import "github.com/pkg/errors"
+
+func newFileWatcher() (fileWatcher, error) {
+	return nil, errors.New("watching files is only supported on linux")
+}
@@ -0,0 +1,130 @@
+package lake
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// syncBuffer is a bytes.Buffer that can be written to while it's read
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func TestWatch(t *testing.T) {
+	if w, err := newFileWatcher(); err != nil {
+		t.Skip(err)
+	} else {
+		_ = w.Close()
+		for range w.Events() {
+		}
+	}
+	dir := t.TempDir()
+	writeFile := func(name, contents string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lakefile := func(suffix string) string {
+		return `
+store "copy" {
+  inputs = ["./*.txt"]
+  script = "read line < in.txt && echo $line` + suffix + ` > $out/out"
+}
+`
+	}
+	writeFile("in.txt", "one\n")
+	writeFile(LakeFilename, lakefile(""))
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outputs := make(chan string, 10)
+	var paths []string
+	var log syncBuffer
+	watcher := &Watcher{
+		Parse: func() (*LocalBuilder, map[string]Value, error) {
+			ws := NewWorkspace(dir)
+			values, _, diags := ws.ParseDirectory(dir)
+			if diags.HasErrors() {
+				return nil, nil, diags
+			}
+			builder := NewLocalBuilder(store, ws)
+			builder.Stdout, builder.Stderr = &log, &log
+			return builder, values, nil
+		},
+		Name: "copy",
+		Run: func(builder *LocalBuilder, recipe Recipe) error {
+			paths = append(paths, builder.store.OutputPath(recipe.Hash()))
+			b, err := os.ReadFile(filepath.Join(builder.store.OutputPath(recipe.Hash()), "out"))
+			outputs <- string(b)
+			return err
+		},
+		Debounce: 20 * time.Millisecond,
+		Log:      &log,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- watcher.Watch(ctx) }()
+
+	next := func() string {
+		select {
+		case output := <-outputs:
+			return output
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for a rebuild, log:\n%s", log.String())
+		}
+		return ""
+	}
+	assert.Equal(t, "one\n", next())
+
+	// A burst of saves is one rebuild
+	writeFile("in.txt", "t")
+	writeFile("in.txt", "two\n")
+	assert.Equal(t, "two\n", next())
+
+	// Changing the Lakefile reparses the package
+	writeFile(LakeFilename, lakefile("!"))
+	assert.Equal(t, "two!\n", next())
+
+	// Files matching the glob are watched, even new ones
+	writeFile("new.txt", "")
+	assert.Equal(t, "two!\n", next())
+
+	// Other files aren't
+	writeFile("other.md", "")
+	select {
+	case output := <-outputs:
+		t.Fatalf("unexpected rebuild with output %q", output)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cancel()
+	assert.NoError(t, <-done)
+	assert.Contains(t, log.String(), "in.txt changed")
+
+	// Changed files give the store a new path, earlier outputs are untouched
+	assert.NotEqual(t, paths[0], paths[1])
+	b, _ := os.ReadFile(filepath.Join(paths[0], "out"))
+	assert.Equal(t, "one\n", string(b))
+}
@@ -1,20 +1,685 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/maxmcd/lake/go-implementation/archive"
 	"github.com/maxmcd/lake/go-implementation/lake"
+	"github.com/pkg/errors"
 )
 
 func main() {
-	directory, pkg, diags := lake.ParseDirectory(".", lake.TmpLoadLakeImport)
+	// Builds are cancelled on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	err := run(ctx, os.Args[1:])
+	stop()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("lake", flag.ContinueOnError)
+	system := flags.String("system", lake.HostSystem(), "the system to evaluate packages for")
+	substituters := flags.String("substituters", os.Getenv(lake.SubstitutersEnvVar),
+		"space separated binary cache urls to fetch store outputs from")
+	trustedPublicKeys := flags.String("trusted-public-keys", os.Getenv(lake.TrustedPublicKeysEnvVar),
+		"space separated public keys that substituted store outputs must be signed by")
+	variables := variableFlags{}
+	flags.Var(variables, "var", "set a variable, as name=value, can be given more than once")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	c := cli{
+		system:            *system,
+		substituters:      strings.Fields(*substituters),
+		trustedPublicKeys: *trustedPublicKeys,
+		variables:         variables,
+	}
+
+	args = flags.Args()
+	if len(args) == 0 {
+		return c.printPackage()
+	}
+	switch args[0] {
+	case "build":
+		return c.build(ctx, args[1:])
+	case "cache":
+		return c.cache(args[1:])
+	case "run":
+		return c.runTarget(ctx, args[1:])
+	case "show-derivation":
+		return c.showDerivation(args[1:])
+	case "push":
+		return c.push(args[1:])
+	case "keys":
+		return c.keys(args[1:])
+	case "store":
+		return c.storeCommand(args[1:])
+	case "log":
+		return c.log(args[1:])
+	case "shell":
+		return c.shell(ctx, args[1:])
+	case "deps":
+		return c.deps(args[1:])
+	case "why":
+		return c.why(args[1:])
+	case "watch":
+		return c.watch(ctx, args[1:])
+	}
+	return errors.Errorf("unknown command %q", args[0])
+}
+
+// errDiagnostics is returned once diagnostics have been printed
+var errDiagnostics = errors.New("error parsing Lakefiles")
+
+// cli holds the global flags shared by every command
+type cli struct {
+	system            string
+	substituters      []string
+	trustedPublicKeys string
+	variables         map[string]string
+}
+
+// variableFlags collects repeated -var name=value flags
+type variableFlags map[string]string
+
+func (v variableFlags) String() string { return "" }
+
+func (v variableFlags) Set(s string) error {
+	name, value, found := strings.Cut(s, "=")
+	if !found || name == "" {
+		return errors.Errorf("invalid variable %q, expected name=value", s)
+	}
+	v[name] = value
+	return nil
+}
+
+// parsePackage parses the package in the working directory
+func (c cli) parsePackage() (*lake.Workspace, map[string]lake.Value, error) {
+	ws, values, _, err := c.parsePackageWithGraph()
+	return ws, values, err
+}
+
+// parsePackageWithGraph is parsePackage that also returns the package's
+// dependency graph
+func (c cli) parsePackageWithGraph() (*lake.Workspace, map[string]lake.Value, lake.DependencyGraph, error) {
+	ws, err := lake.NewWorkspaceFromWorkingDirectory()
+	if err != nil {
+		return nil, nil, lake.DependencyGraph{}, err
+	}
+	ws.System = c.system
+	ws.Variables = c.variables
+	values, pkg, diags := ws.ParseDirectory(".")
 	if diags.HasErrors() {
-		lake.PrintDiagnostics(pkg.FileMap(), diags)
-		return
+		_ = lake.PrintDiagnostics(pkg.FileMap(), diags)
+		return nil, nil, lake.DependencyGraph{}, errDiagnostics
+	}
+	return ws, values, ws.DependencyGraph(pkg), nil
+}
+
+func (c cli) printPackage() error {
+	_, directory, err := c.parsePackage()
+	if err != nil {
+		return err
 	}
 
 	encoder := json.NewEncoder(os.Stdout)
 	encoder.SetIndent("", "  ")
-	encoder.Encode(directory)
+	return encoder.Encode(directory)
+}
+
+func lookupRecipe(values map[string]lake.Value, name string) (lake.Recipe, error) {
+	recipe, found := values[name].Recipe()
+	if found {
+		return recipe, nil
+	}
+	// Blocks with for_each create a recipe named name["key"] for each key
+	var names []string
+	for key, value := range values {
+		if _, isRecipe := value.Recipe(); isRecipe && strings.HasPrefix(key, name+`["`) {
+			names = append(names, key)
+		}
+	}
+	if len(names) > 0 {
+		sort.Strings(names)
+		return lake.Recipe{}, errors.Errorf("%q has a recipe for each of its for_each keys, pick one of: %s",
+			name, strings.Join(names, ", "))
+	}
+	return lake.Recipe{}, errors.Errorf("no store or target named %q", name)
+}
+
+func openStore() (lake.Store, error) {
+	root, err := lake.DefaultStoreRoot()
+	if err != nil {
+		return lake.Store{}, err
+	}
+	return lake.NewStore(root)
+}
+
+func (c cli) newBuilder() (*lake.LocalBuilder, map[string]lake.Value, error) {
+	ws, values, err := c.parsePackage()
+	if err != nil {
+		return nil, nil, err
+	}
+	store, err := openStore()
+	if err != nil {
+		return nil, nil, err
+	}
+	builder := lake.NewLocalBuilder(store, ws)
+	if builder.TrustedKeys, err = lake.ParsePublicKeys(c.trustedPublicKeys); err != nil {
+		return nil, nil, err
+	}
+	for _, rawURL := range c.substituters {
+		cache, err := lake.NewBinaryCache(rawURL)
+		if err != nil {
+			return nil, nil, err
+		}
+		builder.Substituters = append(builder.Substituters, cache)
+	}
+	return builder, values, nil
+}
+
+// build builds the named recipes in the current package and prints their
+// output paths. With --check stores that have already been built are rebuilt
+// and compared with the existing output.
+func (c cli) build(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("build", flag.ContinueOnError)
+	check := flags.Bool("check", false, "rebuild stores that are already built and check that the output is the same")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	builder, values, err := c.newBuilder()
+	if err != nil {
+		return err
+	}
+	var stopProgress func()
+	builder.Progress, stopProgress = lake.NewProgress(os.Stdout, os.Stderr)
+	defer stopProgress()
+	var unreproducible []string
+	for _, name := range flags.Args() {
+		recipe, err := lookupRecipe(values, name)
+		if err != nil {
+			return err
+		}
+		path, err := builder.Build(ctx, recipe)
+		if err != nil {
+			return err
+		}
+		if *check && recipe.IsStore {
+			differences, err := builder.Check(ctx, recipe)
+			if err != nil {
+				return err
+			}
+			if len(differences) > 0 {
+				unreproducible = append(unreproducible, name)
+				fmt.Fprintf(os.Stderr, "%q is not reproducible, the rebuild is at %s:\n",
+					name, builder.CheckPath(recipe))
+				for _, difference := range differences {
+					fmt.Fprintf(os.Stderr, "  %s\n", difference)
+				}
+			}
+		}
+		fmt.Println(path)
+	}
+	if len(unreproducible) > 0 {
+		return errors.Errorf("not reproducible: %s", strings.Join(unreproducible, ", "))
+	}
+	return nil
+}
+
+// runTarget materializes a target and runs it from the working directory with
+// the remaining arguments
+func (c cli) runTarget(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: lake run <target> [args...]")
+	}
+	builder, values, err := c.newBuilder()
+	if err != nil {
+		return err
+	}
+	recipe, err := lookupRecipe(values, args[0])
+	if err != nil {
+		return err
+	}
+	if recipe.IsStore {
+		return errors.Errorf("%q is a store, only targets can be run", args[0])
+	}
+	var stopProgress func()
+	builder.Progress, stopProgress = lake.NewProgress(os.Stdout, os.Stderr)
+	wrapper, err := builder.Build(ctx, recipe)
+	stopProgress()
+	if err != nil {
+		return err
+	}
+	unlock, err := builder.LockCacheDirectories(recipe)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	cmd := exec.Command(wrapper, args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+// watch builds a recipe and prints its output path, then rebuilds it whenever
+// its local files or the Lakefiles change until interrupted
+func (c cli) watch(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("watch", flag.ContinueOnError)
+	debounce := flags.Duration("debounce", 200*time.Millisecond, "how long to wait for changes to stop before rebuilding")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: lake watch [--debounce duration] <recipe>")
+	}
+	progress := lake.NewLineProgress(os.Stdout, os.Stderr)
+	watcher := &lake.Watcher{
+		Parse: func() (*lake.LocalBuilder, map[string]lake.Value, error) {
+			builder, values, err := c.newBuilder()
+			if err != nil {
+				return nil, nil, err
+			}
+			builder.Progress = progress
+			return builder, values, nil
+		},
+		Name: flags.Arg(0),
+		Run: func(builder *lake.LocalBuilder, recipe lake.Recipe) error {
+			path, err := builder.Build(ctx, recipe)
+			if err == nil {
+				fmt.Println(path)
+			}
+			return err
+		},
+		Debounce: *debounce,
+		Log:      os.Stderr,
+	}
+	return watcher.Watch(ctx)
+}
+
+// shell builds the inputs of a recipe and starts an interactive shell with the
+// environment the recipe's script would see. $SHELL is used unless --pure is
+// set, in which case the host environment is left out and the recipe's own
+// shell is used.
+func (c cli) shell(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("shell", flag.ContinueOnError)
+	pure := flags.Bool("pure", false, "don't pass through the host environment")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: lake shell [--pure] <recipe>")
+	}
+	builder, values, err := c.newBuilder()
+	if err != nil {
+		return err
+	}
+	recipe, err := lookupRecipe(values, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	out, err := os.MkdirTemp("", "lake-shell-out-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(out)
+	for _, output := range recipe.Outputs {
+		// Other outputs are created next to $out
+		defer os.RemoveAll(out + "-" + output)
+	}
+
+	var stopProgress func()
+	builder.Progress, stopProgress = lake.NewProgress(os.Stdout, os.Stderr)
+	env, shell, err := builder.ShellEnv(ctx, recipe, out, *pure)
+	stopProgress()
+	if err != nil {
+		return err
+	}
+	unlock, err := builder.LockCacheDirectories(recipe)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if hostShell := os.Getenv("SHELL"); hostShell != "" && !*pure {
+		shell = []string{hostShell}
+	}
+	fmt.Fprintf(os.Stderr, "entering a shell for %q, $out is %s and is removed on exit\n", recipe.Name, out)
+	cmd := exec.Command(shell[0], shell[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = env
+	return cmd.Run()
+}
+
+// deps prints everything a name depends on, including names in imported
+// packages which are printed as <import>:<name>. With --tree the dependencies
+// are printed as a tree, names that have already been expanded are marked
+// with (*).
+func (c cli) deps(args []string) error {
+	flags := flag.NewFlagSet("deps", flag.ContinueOnError)
+	tree := flags.Bool("tree", false, "print dependencies as a tree")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: lake deps [--tree] <name>")
+	}
+	_, _, graph, err := c.parsePackageWithGraph()
+	if err != nil {
+		return err
+	}
+	root := lake.ParseDependency(flags.Arg(0))
+	if !graph.Has(root) {
+		return errors.Errorf("%q isn't declared in the package or its imports", root)
+	}
+	if !*tree {
+		for _, dep := range graph.Transitive(root) {
+			fmt.Println(dep)
+		}
+		return nil
+	}
+
+	fmt.Println(root)
+	expanded := map[lake.Dependency]struct{}{root: {}}
+	var printTree func(dep lake.Dependency, indent string)
+	printTree = func(dep lake.Dependency, indent string) {
+		deps := graph.Dependencies(dep)
+		for i, child := range deps {
+			branch, nextIndent := "├── ", "│   "
+			if i == len(deps)-1 {
+				branch, nextIndent = "└── ", "    "
+			}
+			if _, found := expanded[child]; found && len(graph.Dependencies(child)) > 0 {
+				fmt.Printf("%s%s%s (*)\n", indent, branch, child)
+				continue
+			}
+			expanded[child] = struct{}{}
+			fmt.Printf("%s%s%s\n", indent, branch, child)
+			printTree(child, indent+nextIndent)
+		}
+	}
+	printTree(root, "")
+	return nil
+}
+
+// why prints a shortest chain of references from one name to another
+func (c cli) why(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: lake why <from> <to>")
+	}
+	_, _, graph, err := c.parsePackageWithGraph()
+	if err != nil {
+		return err
+	}
+	path, err := graph.Path(lake.ParseDependency(args[0]), lake.ParseDependency(args[1]))
+	if err != nil {
+		return err
+	}
+	for i, dep := range path {
+		fmt.Printf("%s%s\n", strings.Repeat("  ", i), dep)
+	}
+	return nil
+}
+
+// showDerivation prints the derivation of a recipe in the current package
+func (c cli) showDerivation(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: lake show-derivation <name>")
+	}
+	_, values, err := c.parsePackage()
+	if err != nil {
+		return err
+	}
+	recipe, err := lookupRecipe(values, args[0])
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Printf("%s\n", recipe.Derivation().Indented())
+	return err
+}
+
+// push uploads built stores and their dependencies to a binary cache
+func (c cli) push(args []string) error {
+	flags := flag.NewFlagSet("push", flag.ContinueOnError)
+	to := flags.String("to", "", "the binary cache url to push to, defaults to the first substituter")
+	signKey := flags.String("sign-key", os.Getenv(lake.SecretKeyFileEnvVar),
+		"the secret key file to sign pushed outputs with")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *to == "" && len(c.substituters) > 0 {
+		*to = c.substituters[0]
+	}
+	if *to == "" || flags.NArg() == 0 {
+		return errors.New("usage: lake push [--to url] <store>...")
+	}
+	cache, err := lake.NewBinaryCache(*to)
+	if err != nil {
+		return err
+	}
+	builder, values, err := c.newBuilder()
+	if err != nil {
+		return err
+	}
+	if *signKey != "" {
+		key, err := lake.ReadSecretKeyFile(*signKey)
+		if err != nil {
+			return err
+		}
+		builder.SigningKey = &key
+	}
+	for _, name := range flags.Args() {
+		recipe, err := lookupRecipe(values, name)
+		if err != nil {
+			return err
+		}
+		if err := builder.Push(cache, recipe); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keys handles `lake keys generate [--out dir] [--force] <name>`. The key pair
+// is written to <name>.secret and <name>.public and the public key is printed.
+// Existing keys are only replaced with --force, losing a secret key means
+// nothing can be signed for the caches that trust it.
+func (c cli) keys(args []string) error {
+	usage := errors.New("usage: lake keys generate [--out dir] [--force] <name>")
+	if len(args) == 0 || args[0] != "generate" {
+		return usage
+	}
+	flags := flag.NewFlagSet("keys generate", flag.ContinueOnError)
+	out := flags.String("out", ".", "the directory to write the key pair to")
+	force := flags.Bool("force", false, "replace an existing key pair")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return usage
+	}
+	name := flags.Arg(0)
+	secret, public, err := lake.GenerateKey(name)
+	if err != nil {
+		return err
+	}
+	secretPath := filepath.Join(*out, name+".secret")
+	publicPath := filepath.Join(*out, name+".public")
+	if !*force {
+		for _, path := range []string{secretPath, publicPath} {
+			if _, err := os.Lstat(path); err == nil {
+				return errors.Errorf("%s already exists, use --force to replace it", path)
+			}
+		}
+	}
+	if err := writeKeyFile(secretPath, secret.String(), 0600, *force); err != nil {
+		return errors.Wrap(err, "error writing secret key")
+	}
+	if err := writeKeyFile(publicPath, public.String(), 0644, *force); err != nil {
+		return errors.Wrap(err, "error writing public key")
+	}
+	fmt.Println(public)
+	return nil
+}
+
+// writeKeyFile writes a key to path, failing if the file exists unless force
+// is set
+func writeKeyFile(path, key string, perm os.FileMode, force bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(key + "\n"); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// log prints the log of the last build of a store, given by name or by hash.
+// Logs are kept for failed builds too. With --check the log of the last
+// rebuild by lake build --check is printed instead.
+func (c cli) log(args []string) error {
+	flags := flag.NewFlagSet("log", flag.ContinueOnError)
+	check := flags.Bool("check", false, "print the log of the last check of the store")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: lake log [--check] <name|hash>")
+	}
+	hash, err := c.resolveHash(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	store, err := openStore()
+	if err != nil {
+		return err
+	}
+	open, kind := store.OpenLog, "build"
+	if *check {
+		open, kind = store.OpenCheckLog, "check"
+	}
+	log, err := open(hash)
+	if os.IsNotExist(errors.Cause(err)) {
+		return errors.Errorf("no %s log for %q", kind, flags.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+	_, err = io.Copy(os.Stdout, log)
+	return err
+}
+
+// resolveHash returns arg if it's a hash, otherwise the hash of the recipe in
+// the current package that it names
+func (c cli) resolveHash(arg string) (string, error) {
+	if lake.IsHash(arg) {
+		return arg, nil
+	}
+	_, values, err := c.parsePackage()
+	if err != nil {
+		return "", err
+	}
+	recipe, err := lookupRecipe(values, arg)
+	if err != nil {
+		return "", err
+	}
+	return recipe.Hash(), nil
+}
+
+// storeCommand handles `lake store dump <path>`, which writes the archive of a
+// file or directory to stdout, `lake store restore <path>`, which reads an
+// archive from stdin and recreates it at path, `lake store info <name|hash>`,
+// which prints what the store database records about an output, and `lake
+// store list`, which prints every valid output
+func (c cli) storeCommand(args []string) error {
+	if len(args) == 1 && args[0] == "list" {
+		return c.listStore()
+	}
+	if len(args) != 2 {
+		return errors.New("usage: lake store dump <path> | lake store restore <path> | lake store info <name|hash> | lake store list")
+	}
+	switch args[0] {
+	case "info":
+		return c.storeInfo(args[1])
+	case "dump":
+		w := bufio.NewWriter(os.Stdout)
+		if err := archive.Dump(w, args[1]); err != nil {
+			return err
+		}
+		return w.Flush()
+	case "restore":
+		return archive.Restore(bufio.NewReader(os.Stdin), args[1])
+	}
+	return errors.Errorf("unknown store command %q", args[0])
+}
+
+func (c cli) storeInfo(arg string) error {
+	hash, err := c.resolveHash(arg)
+	if err != nil {
+		return err
+	}
+	store, err := openStore()
+	if err != nil {
+		return err
+	}
+	info, valid, err := store.QueryPath(hash)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return errors.Errorf("%q hasn't been built", arg)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(info)
+}
+
+func (c cli) listStore() error {
+	store, err := openStore()
+	if err != nil {
+		return err
+	}
+	infos, err := store.ValidPaths()
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		fmt.Printf("%s %s\n", store.OutputPath(info.Hash), info.Name)
+	}
+	return nil
+}
+
+// cache handles `lake cache clean [recipe]`
+func (c cli) cache(args []string) error {
+	if len(args) == 0 || args[0] != "clean" || len(args) > 2 {
+		return errors.New("usage: lake cache clean [recipe]")
+	}
+	store, err := openStore()
+	if err != nil {
+		return err
+	}
+	var name string
+	if len(args) == 2 {
+		name = args[1]
+	}
+	return store.CleanCache(name)
 }